@@ -36,6 +36,9 @@ export interface KubernetesFileBatchInput {
 
   // Max number of lines per split file
   readonly maxSplitLines?: number;
+
+  // 'efs' to split the input into files on EFS, 'range' to process byte ranges of the input directly from S3
+  readonly splitMode?: string;
 }
 
 // Main class
@@ -46,6 +49,7 @@ export class KubernetesFileBatchConstruct extends Construct {
   readonly desiredNodes?: number;
   readonly inputBucket?: s3.Bucket;
   readonly maxSplitLines?: number;
+  readonly splitMode?: string;
 
   constructor(scope: Construct, id: string, props: KubernetesFileBatchInput) {
     super(scope, id);
@@ -59,6 +63,7 @@ export class KubernetesFileBatchConstruct extends Construct {
     this.desiredNodes = props.desiredNodes ?? 5;
     this.maxNodes = props.maxNodes ?? 5;
     this.maxSplitLines = props.maxSplitLines ?? 30000;
+    this.splitMode = props.splitMode ?? 'efs';
 
     // Custom security group
     const securityGroup = new ec2.SecurityGroup(this, this.getId('security-group'), {
@@ -362,10 +367,28 @@ export class KubernetesFileBatchConstruct extends Construct {
     // Docker image for split-file k8s job
     redis: elasticcache.CfnReplicationGroup, securityGroup: ec2.SecurityGroup, batchServiceAccount: eks.ServiceAccount): stepFunctions.StateMachine {
     const splitFileAsset = new DockerImageAsset(this, this.getId('split-file-image'), {
-      directory: path.join(__dirname, '../src/split-file'),
+      directory: path.join(__dirname, '../src'),
+      file: 'split-file/Dockerfile',
     });
 
-    // This job internally leverages unix split command to break files into multiple lines and copy it to EFS directory
+    // Jobs of the range split mode stream the input from S3 and do not mount EFS
+    const efsVolumeMounts = this.splitMode === 'range' ? [] : [
+      {
+        name: 'persistent-storage',
+        mountPath: '/data',
+      },
+    ];
+    const efsVolumes = this.splitMode === 'range' ? [] : [
+      {
+        name: 'persistent-storage',
+        persistentVolumeClaim: {
+          claimName: 'efs-storage-claim',
+        },
+      },
+    ];
+
+    // This job streams the file from S3 and breaks it into files of MAX_LINES_PER_BATCH records, each repeating the header row,
+    // on the EFS directory, or computes byte ranges of MAX_LINES_PER_BATCH records of the file when SPLIT_MODE is range
     const splitFileTask = new stepFunctions.CustomState(this, 'split-file-job', {
       stateJson: {
         Type: 'Task',
@@ -417,6 +440,10 @@ export class KubernetesFileBatchConstruct extends Construct {
                           name: 'MAX_LINES_PER_BATCH',
                           value: `${this.maxSplitLines}`,
                         },
+                        {
+                          name: 'SPLIT_MODE',
+                          value: `${this.splitMode}`,
+                        },
                         {
                           name: 'REDIS_CACHE_ENDPOINT',
                           value: `${redis.attrConfigurationEndPointAddress}`,
@@ -430,22 +457,10 @@ export class KubernetesFileBatchConstruct extends Construct {
                           value: 'us-east-1',
                         },
                       ],
-                      volumeMounts: [
-                        {
-                          name: 'persistent-storage',
-                          mountPath: '/data',
-                        },
-                      ],
-                    },
-                  ],
-                  volumes: [
-                    {
-                      name: 'persistent-storage',
-                      persistentVolumeClaim: {
-                        claimName: 'efs-storage-claim',
-                      },
+                      volumeMounts: efsVolumeMounts,
                     },
                   ],
+                  volumes: efsVolumes,
                   restartPolicy: 'Never',
                 },
               },
@@ -486,10 +501,11 @@ export class KubernetesFileBatchConstruct extends Construct {
 
     // File processor docker image
     const mapProcessFileAsset = new DockerImageAsset(this, this.getId('map-process-asset'), {
-      directory: path.join(__dirname, '../src/file-processor'),
+      directory: path.join(__dirname, '../src'),
+      file: 'file-processor/Dockerfile',
     });
 
-    // Task to process split file, save data in dynamodb and write output file back to EFS
+    // Task to process split file or byte range, save data in dynamodb and write output file back to EFS or S3
     const mapState = new stepFunctions.CustomState(this, this.getId('file-map-version'), {
       stateJson: {
         Type: 'Task',
@@ -554,22 +570,10 @@ export class KubernetesFileBatchConstruct extends Construct {
                           value: 'us-east-1',
                         },
                       ],
-                      volumeMounts: [
-                        {
-                          name: 'persistent-storage',
-                          mountPath: '/data',
-                        },
-                      ],
-                    },
-                  ],
-                  volumes: [
-                    {
-                      name: 'persistent-storage',
-                      persistentVolumeClaim: {
-                        claimName: 'efs-storage-claim',
-                      },
+                      volumeMounts: efsVolumeMounts,
                     },
                   ],
+                  volumes: efsVolumes,
                   restartPolicy: 'Never',
                 },
               },
@@ -612,7 +616,8 @@ export class KubernetesFileBatchConstruct extends Construct {
 
     // file processor docker image
     const asset = new DockerImageAsset(this, this.getId('single-threaded-image'), {
-      directory: path.join(__dirname, '../src/single-thread-processor'),
+      directory: path.join(__dirname, '../src'),
+      file: 'single-thread-processor/Dockerfile',
     });
 
     // Step running the file processor as k8s job
@@ -0,0 +1,32 @@
+package dynamowriter
+
+import (
+	"fmt"
+	"log"
+	"record.schema/recordschema"
+)
+
+/*
+	Handles the results of the batches within the error budget. The response of a batch
+	saved in DynamoDB is passed to output, the rows of a batch failing to be saved go to
+	the dead letter file.
+*/
+func NewBudgetHandler(budget *ErrorBudget, deadLetters *recordschema.DeadLetterWriter, output func(response map[string]string) error) BatchHandler {
+	return func(batch *Batch, response map[string]string, err error) error {
+		if err != nil {
+			log.Printf("Error while saving data to dynamodb %s", err.Error())
+			errWrite := deadLetters.Write(batch.Rows)
+			if errWrite != nil {
+				return fmt.Errorf("Error while writing dead letter file %s", errWrite.Error())
+			}
+			return budget.Failed(len(batch.Items))
+		}
+		budget.Succeeded(len(batch.Items))
+
+		err = output(response)
+		if err != nil {
+			return fmt.Errorf("Error while appending output file")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,121 @@
+package dynamowriter
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const (
+	ErrorTolerated              = "ERROR_TOLERATED"
+	MaxFailedRecords            = "MAX_FAILED_RECORDS"
+	MaxFailedPercent            = "MAX_FAILED_PERCENT"
+	MaxConsecutiveFailedBatches = "MAX_CONSECUTIVE_FAILED_BATCHES"
+
+	unlimited = -1
+)
+
+/*
+	Limits of the records failing to be written to DynamoDB before the workload fails,
+	a negative limit is unlimited
+*/
+type ErrorBudget struct {
+	MaxFailedRecords            int
+	MaxFailedPercent            float64
+	MaxConsecutiveFailedBatches int
+
+	records            int
+	failedRecords      int
+	failedBatches      int
+	consecutiveBatches int
+}
+
+/*
+	Env variables to determine the error budget. Without any of the limits set,
+	ERROR_TOLERATED=false fails the workload in case of a single error and any
+	other value ignores all of them.
+*/
+func GetErrorBudget() (*ErrorBudget, error) {
+	budget := &ErrorBudget{
+		MaxFailedRecords:            unlimited,
+		MaxFailedPercent:            unlimited,
+		MaxConsecutiveFailedBatches: unlimited,
+	}
+	if os.Getenv(MaxFailedRecords) == "" && os.Getenv(MaxFailedPercent) == "" && os.Getenv(MaxConsecutiveFailedBatches) == "" {
+		if tolerated, err := strconv.ParseBool(os.Getenv(ErrorTolerated)); err == nil && !tolerated {
+			budget.MaxFailedRecords = 0
+		}
+		return budget, nil
+	}
+
+	var err error
+	if value := os.Getenv(MaxFailedRecords); value != "" {
+		if budget.MaxFailedRecords, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q", MaxFailedRecords, value)
+		}
+	}
+	if value := os.Getenv(MaxFailedPercent); value != "" {
+		if budget.MaxFailedPercent, err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, fmt.Errorf("invalid %s %q", MaxFailedPercent, value)
+		}
+	}
+	if value := os.Getenv(MaxConsecutiveFailedBatches); value != "" {
+		if budget.MaxConsecutiveFailedBatches, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q", MaxConsecutiveFailedBatches, value)
+		}
+	}
+	return budget, nil
+}
+
+/*
+	Counts a batch written to DynamoDB
+*/
+func (b *ErrorBudget) Succeeded(records int) {
+	b.records += records
+	b.consecutiveBatches = 0
+}
+
+/*
+	Counts a batch failing to be written to DynamoDB, returns an error once the failed
+	records or the consecutive failed batches exceed their limit
+*/
+func (b *ErrorBudget) Failed(records int) error {
+	b.records += records
+	b.failedRecords += records
+	b.failedBatches++
+	b.consecutiveBatches++
+
+	if b.MaxFailedRecords >= 0 && b.failedRecords > b.MaxFailedRecords {
+		return fmt.Errorf("error budget exceeded, %d failed records over the limit of %d", b.failedRecords, b.MaxFailedRecords)
+	}
+	if b.MaxConsecutiveFailedBatches >= 0 && b.consecutiveBatches > b.MaxConsecutiveFailedBatches {
+		return fmt.Errorf("error budget exceeded, %d consecutive failed batches over the limit of %d", b.consecutiveBatches, b.MaxConsecutiveFailedBatches)
+	}
+	return nil
+}
+
+/*
+	Checks the percentage of failed records, once all the records are written
+*/
+func (b *ErrorBudget) Check() error {
+	if b.MaxFailedPercent < 0 || b.records == 0 {
+		return nil
+	}
+
+	percent := float64(b.failedRecords) * 100 / float64(b.records)
+	if percent > b.MaxFailedPercent {
+		return fmt.Errorf("error budget exceeded, %.2f%% failed records over the limit of %v%%", percent, b.MaxFailedPercent)
+	}
+	return nil
+}
+
+/*
+	Number of records failing to be written so far
+*/
+func (b *ErrorBudget) FailedRecords() int {
+	return b.failedRecords
+}
+
+func (b *ErrorBudget) String() string {
+	return fmt.Sprintf("%d of %d records failed in %d batches", b.failedRecords, b.records, b.failedBatches)
+}
@@ -0,0 +1,149 @@
+package dynamowriter
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/google/uuid"
+	"log"
+	"math"
+	"math/rand"
+	"record.schema/recordschema"
+	"time"
+)
+
+const maxRetries = 10
+
+/*
+	Writes the items of a record schema to its DynamoDB table
+*/
+type Writer struct {
+	svc    dynamodbiface.DynamoDBAPI
+	schema *recordschema.Schema
+}
+
+func NewWriter(svc dynamodbiface.DynamoDBAPI, schema *recordschema.Schema) *Writer {
+	return &Writer{svc: svc, schema: schema}
+}
+
+/*
+	Batch Dynamodb writes upto 25 items per request, also returning the number of times
+	the request was throttled
+*/
+func (w *Writer) BatchWriteItem(items []*recordschema.Item) (map[string]string, int, error) {
+	var request []*dynamodb.WriteRequest
+	response := map[string]string{}
+	for _, v := range items {
+		attributes := make(map[string]*dynamodb.AttributeValue, len(v.Attributes)+1)
+		for name, value := range v.Attributes {
+			attributes[name] = value
+		}
+
+		confirmationId := ""
+		if w.schema.ConfirmationAttribute != "" {
+			confirmationId = uuid.NewString()
+			attributes[w.schema.ConfirmationAttribute] = &dynamodb.AttributeValue{S: aws.String(confirmationId)}
+		}
+		response[v.Key] = confirmationId
+		request = append(request, &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{Item: attributes},
+		})
+	}
+
+	/*
+		Implement retry with backoff in case of throttledException and if the response
+		contains any unprocessed results
+	*/
+	index := 0
+	for index < maxRetries {
+		result, err := w.svc.BatchWriteItem(
+			&dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]*dynamodb.WriteRequest{
+					w.schema.Table: request,
+				}})
+
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				switch aerr.Code() {
+				case dynamodb.ErrCodeProvisionedThroughputExceededException:
+					index++
+					if result != nil && len(result.UnprocessedItems[w.schema.Table]) > 0 {
+						request = result.UnprocessedItems[w.schema.Table]
+					}
+				default:
+					log.Printf("Error while performing batch write %s", aerr.Error())
+					return nil, index, aerr
+				}
+			} else {
+				log.Printf("Unknown error encountered %s", err.Error())
+				return nil, index, err
+			}
+		} else {
+			if result != nil && len(result.UnprocessedItems[w.schema.Table]) > 0 {
+				request = result.UnprocessedItems[w.schema.Table]
+				index++
+			} else {
+				break
+			}
+		}
+		if index < maxRetries {
+			time.Sleep(retryBackoff(index))
+		}
+	}
+
+	if index >= maxRetries {
+		return nil, index, errors.New("max retries exceeded, unable to process the batch")
+	} else {
+		return response, index, nil
+	}
+}
+
+/*
+	Write units of the put requests of a batch, one per started KB of each item. The size
+	of an item is the length of its attribute names and values, with the confirmation
+	attribute added to every item.
+*/
+func (w *Writer) writeUnits(items []*recordschema.Item) float64 {
+	confirmationSize := 0
+	if w.schema.ConfirmationAttribute != "" {
+		confirmationSize = len(w.schema.ConfirmationAttribute) + len(uuid.Nil.String())
+	}
+
+	units := 0.0
+	for _, item := range items {
+		size := confirmationSize
+		for name, value := range item.Attributes {
+			size += len(name) + attributeSize(value)
+		}
+		units += math.Ceil(float64(size) / 1024)
+	}
+	return units
+}
+
+/*
+	Size of the string, number and boolean values the record schema maps to
+*/
+func attributeSize(value *dynamodb.AttributeValue) int {
+	switch {
+	case value.S != nil:
+		return len(*value.S)
+	case value.N != nil:
+		return len(*value.N)
+	case value.BOOL != nil:
+		return 1
+	}
+	return 0
+}
+
+/*
+	Exponential backoff with full jitter, from 50ms up to 5s
+*/
+func retryBackoff(retry int) time.Duration {
+	backoff := 50 * time.Millisecond << uint(retry)
+	if backoff > 5*time.Second {
+		backoff = 5 * time.Second
+	}
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
@@ -0,0 +1,211 @@
+package dynamowriter
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"record.schema/recordschema"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	MaxWriters          = "DYNAMODB_MAX_WRITERS"
+	WriteUnitsPerSecond = "DYNAMODB_WRITE_UNITS_PER_SECOND"
+
+	defaultMaxWriters = 8
+)
+
+/*
+	Items of a batch write request with the rows they were mapped from
+*/
+type Batch struct {
+	Items []*recordschema.Item
+	Rows  [][]string
+}
+
+/*
+	Handles the result of a batch, called by one writer at a time. Returning an error
+	stops the pool from accepting new batches.
+*/
+type BatchHandler func(batch *Batch, response map[string]string, err error) error
+
+/*
+	Bounded pool of DynamoDB batch writers. The number of writers sending requests at the
+	same time starts at one, is halved when DynamoDB throttles and grows by one after as
+	many healthy requests as writers, up to DYNAMODB_MAX_WRITERS. DYNAMODB_WRITE_UNITS_PER_SECOND
+	optionally caps the write units consumed per second.
+*/
+type WriterPool struct {
+	writer  *Writer
+	batches chan *Batch
+	handler BatchHandler
+	writers sync.WaitGroup
+
+	mu        sync.Mutex
+	available *sync.Cond
+	max       int
+	limit     int
+	active    int
+	healthy   int
+	err       error
+
+	handlerMu sync.Mutex
+	rate      *rateLimiter
+	closeOnce sync.Once
+}
+
+func NewWriterPool(writer *Writer, handler BatchHandler) (*WriterPool, error) {
+	max, err := getPositiveInt(MaxWriters, defaultMaxWriters)
+	if err != nil {
+		return nil, err
+	}
+	writeUnits, err := getPositiveInt(WriteUnitsPerSecond, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &WriterPool{writer: writer, batches: make(chan *Batch), handler: handler, max: max, limit: 1}
+	pool.available = sync.NewCond(&pool.mu)
+	if writeUnits > 0 {
+		pool.rate = newRateLimiter(float64(writeUnits))
+	}
+
+	pool.writers.Add(max)
+	for i := 0; i < max; i++ {
+		go pool.write()
+	}
+	return pool, nil
+}
+
+/*
+	Queues a batch, waiting for a writer to take it. Once the handler failed, the batch is
+	not queued and the pool is closed, so that the records of the batches being written
+	are known before the error is returned.
+*/
+func (p *WriterPool) Submit(batch *Batch) error {
+	if err := p.Err(); err != nil {
+		p.Close()
+		return err
+	}
+	p.batches <- batch
+	return nil
+}
+
+/*
+	Waits for the queued batches to be written, returns the first error of the handler.
+	Closing the pool again only returns the error.
+*/
+func (p *WriterPool) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.batches)
+		p.writers.Wait()
+	})
+	return p.Err()
+}
+
+func (p *WriterPool) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *WriterPool) write() {
+	defer p.writers.Done()
+	for batch := range p.batches {
+		p.acquire()
+		if p.rate != nil {
+			p.rate.wait(p.writer.writeUnits(batch.Items))
+		}
+		response, throttles, err := p.writer.BatchWriteItem(batch.Items)
+		p.release(throttles > 0)
+
+		p.handlerMu.Lock()
+		errHandler := p.handler(batch, response, err)
+		p.handlerMu.Unlock()
+		if errHandler != nil {
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = errHandler
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *WriterPool) acquire() {
+	p.mu.Lock()
+	for p.active >= p.limit {
+		p.available.Wait()
+	}
+	p.active++
+	p.mu.Unlock()
+}
+
+func (p *WriterPool) release(throttled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+
+	if throttled {
+		p.healthy = 0
+		if p.limit > 1 {
+			p.limit /= 2
+			log.Printf("Throttled by DynamoDB, writing with %d writers", p.limit)
+		}
+	} else {
+		p.healthy++
+		if p.healthy >= p.limit && p.limit < p.max {
+			p.healthy = 0
+			p.limit++
+		}
+	}
+	p.available.Broadcast()
+}
+
+/*
+	Token bucket refilled at the given units per second, holding at most a second of units
+*/
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (r *rateLimiter) wait(units float64) {
+	r.mu.Lock()
+	now := time.Now()
+	r.tokens = math.Min(r.rate, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	r.last = now
+
+	// Reserve the units, waiting for the tokens missing
+	r.tokens -= units
+	delay := time.Duration(-r.tokens / r.rate * float64(time.Second))
+	r.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func getPositiveInt(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	if number == 0 {
+		return defaultValue, nil
+	}
+	return number, nil
+}
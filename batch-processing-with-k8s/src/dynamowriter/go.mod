@@ -0,0 +1,11 @@
+module dynamo.writer/dynamowriter
+
+go 1.16
+
+require (
+	github.com/aws/aws-sdk-go v1.38.25
+	github.com/google/uuid v1.2.0
+	record.schema/recordschema v0.0.0
+)
+
+replace record.schema/recordschema => ../recordschema
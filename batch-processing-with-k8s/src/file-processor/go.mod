@@ -3,7 +3,16 @@ module file.processor/main
 go 1.16
 
 require (
+	dynamo.writer/dynamowriter v0.0.0
 	github.com/aws/aws-sdk-go v1.38.25
 	github.com/redis/go-redis/v9 v9.3.0
 	github.com/google/uuid v1.2.0
+	object.store/objectstore v0.0.0
+	record.schema/recordschema v0.0.0
 )
+
+replace dynamo.writer/dynamowriter => ../dynamowriter
+
+replace object.store/objectstore => ../objectstore
+
+replace record.schema/recordschema => ../recordschema
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"dynamo.writer/dynamowriter"
 	"encoding/csv"
 	"file.processor/main/utils"
 	"fmt"
@@ -8,14 +9,23 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"record.schema/recordschema"
+	"strings"
 )
 
 /*
 	Entry point for batch file processor
 */
 func main() {
-	tolerated := utils.IsErrorTolerated()
-	inputFile, outputFile, tmpFile, err := initialize()
+	budget, err := dynamowriter.GetErrorBudget()
+	if err != nil {
+		failure("Pre-requisites failed unable to proceed further " + err.Error())
+	}
+	inputRange, isRange, err := utils.ParseRange(os.Getenv(utils.InputFile))
+	if err != nil {
+		failure("Pre-requisites failed unable to proceed further " + err.Error())
+	}
+	inputFile, outputFile, tmpFile, err := initialize(inputRange)
 	if err != nil {
 		failure("Pre-requisites failed unable to proceed further " + err.Error())
 	}
@@ -32,61 +42,156 @@ func main() {
 	// Start parsing the inputFile
 	totalRecords := 0
 	reader := csv.NewReader(inputFile)
-	var records []*utils.Record
-	index := 0
+	reader.FieldsPerRecord = -1
+	var records []*recordschema.Item
+	var rows [][]string
+
+	// Map the rows by the column names of the first row header, byte ranges start after it
+	var header []string
+	if isRange {
+		header, err = inputRange.ReadHeader()
+	} else {
+		header, err = reader.Read()
+	}
+	if err != nil {
+		failure("Error while reading the inputFile header " + err.Error())
+	}
+	mapper, err := utils.NewRecordMapper(header)
+	if err != nil {
+		failure("Input does not match the record schema " + err.Error())
+	}
+
+	// Rows failing the schema are written to the reject file instead
+	rejectFile, err := utils.TruncateFile(utils.GetRejectFile())
+	if err != nil {
+		failure("Error while creating reject file " + err.Error())
+	}
+	defer rejectFile.Close()
+	rejects := recordschema.NewRejectWriter(rejectFile, header)
+	if isRange {
+		rejects = recordschema.NewOffsetRejectWriter(rejectFile, header)
+	}
+
+	// Rows failing to be written to DynamoDB are written to the dead letter file
+	deadLetterFile, err := utils.TruncateFile(utils.GetDeadLetterFile())
+	if err != nil {
+		failure("Error while creating dead letter file " + err.Error())
+	}
+	defer deadLetterFile.Close()
+	deadLetters := recordschema.NewDeadLetterWriter(deadLetterFile, header)
+
+	// Batches are saved in DynamoDB by a pool of writers
+	pool, err := dynamowriter.NewWriterPool(utils.NewBatchWriter(), dynamowriter.NewBudgetHandler(budget, deadLetters, func(response map[string]string) error {
+		return utils.AppendFile(response, tmpFile)
+	}))
+	if err != nil {
+		failure("Pre-requisites failed unable to proceed further " + err.Error())
+	}
 
-	// Skip first row header
-	record, errRead := reader.Read()
 	for {
-		record, errRead = reader.Read()
+		offset := reader.InputOffset()
+		record, errRead := reader.Read()
 		if errRead == io.EOF {
 			if len(records) > 0 {
-				processRecords(records, tolerated, tmpFile)
+				err = pool.Submit(&dynamowriter.Batch{Items: records, Rows: rows})
+				if err != nil {
+					failure(err.Error())
+				}
+			}
+			err = pool.Close()
+			if err != nil {
+				failure(err.Error())
+			}
+			err = budget.Check()
+			if err != nil {
+				failure(err.Error())
 			}
 
-			success()
+			uploadFailedRows(inputRange, totalRecords, rejects, deadLetters, budget)
+			success(inputRange)
 			break
 		}
 		if errRead != nil {
+			pool.Close()
 			failure("Error while reading the inputFile records " + errRead.Error())
 		}
-		index++
+		item, errMap := mapper.Map(record)
+		if errMap != nil {
+			// Rows of a byte range are identified by their offset in the whole input
+			var position int64
+			if isRange {
+				position = inputRange.Start + offset
+			} else {
+				line, _ := reader.FieldPos(0)
+				position = int64(line)
+			}
+			err = rejects.Reject(position, errMap.Error(), record)
+			if err != nil {
+				pool.Close()
+				failure("Error while writing reject file " + err.Error())
+			}
+			continue
+		}
+		records = append(records, item)
+		rows = append(rows, record)
 		totalRecords++
 
-		if index == utils.MaxRecordsPerBatch {
-			processRecords(records, tolerated, tmpFile)
+		if len(records) == utils.MaxRecordsPerBatch {
+			err = pool.Submit(&dynamowriter.Batch{Items: records, Rows: rows})
+			if err != nil {
+				failure(err.Error())
+			}
 
-			// Trim data
-			records = records[:0]
-			index = 0
+			// The batch is owned by the writers from now on
+			records, rows = nil, nil
 			log.Printf("Total records so far - %v", totalRecords)
-		} else {
-			records = append(records, utils.MarshalRecord(record))
 		}
 	}
 }
 
 /*
-	Process records, append to tmp file and save the records in DynamoDB
+	Upload the reject and dead letter files when rows were rejected or failed to be
+	saved, and log the summary of the batch
 */
-func processRecords(records []*utils.Record, tolerated bool, tmpFile *os.File) {
-	response, err := utils.BatchWriteItem(records)
-	if err != nil && !tolerated {
-		failure("Error while saving data to dynamodb")
+func uploadFailedRows(inputRange *utils.S3Range, totalRecords int, rejects *recordschema.RejectWriter, deadLetters *recordschema.DeadLetterWriter, budget *dynamowriter.ErrorBudget) {
+	name := utils.GetFileName(os.Getenv(utils.InputFile))
+	if inputRange != nil {
+		name = inputRange.PartName()
 	}
-	err = utils.AppendFile(response, tmpFile)
-	if err != nil {
-		failure("Error while appending output file")
+
+	rejectKey := "none"
+	if rejects.Count() > 0 {
+		err := rejects.Flush()
+		if err != nil {
+			failure("Error while writing reject file " + err.Error())
+		}
+		rejectKey, err = utils.UploadRejects(name)
+		if err != nil {
+			failure("Error while uploading reject file to S3 " + err.Error())
+		}
 	}
+
+	deadLetterKey := "none"
+	if deadLetters.Count() > 0 {
+		err := deadLetters.Flush()
+		if err != nil {
+			failure("Error while writing dead letter file " + err.Error())
+		}
+		deadLetterKey, err = utils.UploadDeadLetters(name)
+		if err != nil {
+			failure("Error while uploading dead letter file to S3 " + err.Error())
+		}
+	}
+	log.Printf("Batch summary - %v records read, %v processed, %v rejected (rejects %s), %s (dead letters %s)", totalRecords+rejects.Count(), totalRecords, rejects.Count(), rejectKey, budget, deadLetterKey)
 }
 
-func success() {
-	err := utils.RemoveFromCache(os.Getenv(utils.InputFile))
-	if err != nil {
-		failure("Error while removing items from cache " + err.Error())
+func success(inputRange *utils.S3Range) {
+	if inputRange != nil {
+		successRange(inputRange)
+		return
 	}
 
-	// Copy contents from source to destination
+	// Copy contents from source to destination, before the last worker moves them all
 	sourceFile := utils.GetTmpFile()
 	destinationFile := utils.GetOutputFile()
 	input, err := ioutil.ReadFile(sourceFile)
@@ -99,8 +204,12 @@ func success() {
 		failure("Error creating" + err.Error())
 	}
 
-	cacheItems := utils.GetDataFromSet()
-	if len(cacheItems) == 0 {
+	last, err := utils.RemoveFromCache(os.Getenv(utils.InputFile))
+	if err != nil {
+		failure("Error while removing items from cache " + err.Error())
+	}
+
+	if last {
 		err = utils.MoveFilesToS3()
 		if err != nil {
 			failure("Error while copying files to S3 " + err.Error())
@@ -110,12 +219,38 @@ func success() {
 	utils.DeleteTmpFile()
 }
 
+/*
+	Upload the output of a byte range to S3, the last range merges the outputs of all of them
+*/
+func successRange(inputRange *utils.S3Range) {
+	err := inputRange.UploadOutput(utils.GetTmpFile())
+	if err != nil {
+		failure("Error while uploading output to S3 " + err.Error())
+	}
+
+	last, err := utils.RemoveFromCache(os.Getenv(utils.InputFile))
+	if err != nil {
+		failure("Error while removing items from cache " + err.Error())
+	}
+
+	if last {
+		err = utils.MergeOutputParts()
+		if err != nil {
+			failure("Error while merging output parts in S3 " + err.Error())
+		}
+	}
+
+	utils.DeleteTmpFile()
+}
+
 /*
 	Cleanup output file
 */
 func failure(msg string) {
 	utils.DeleteProcessedData()
-	utils.DeleteFile(utils.GetOutputFile())
+	if !strings.HasPrefix(os.Getenv(utils.InputFile), "s3://") {
+		utils.DeleteFile(utils.GetOutputFile())
+	}
 	utils.DeleteTmpFile()
 	fmt.Println(msg)
 	panic(msg)
@@ -124,7 +259,24 @@ func failure(msg string) {
 /*
 	Run pre-requisites before executing the batch
 */
-func initialize() (*os.File, *os.File, *os.File, error) {
+func initialize(inputRange *utils.S3Range) (io.ReadCloser, *os.File, *os.File, error) {
+	if inputRange != nil {
+		// Stream the byte range from S3, the output is uploaded from the temp file
+		inputFile, err := inputRange.Open()
+		if err != nil {
+			log.Printf("Error while opening the input range " + err.Error())
+			return nil, nil, nil, err
+		}
+
+		tmpFile, err := utils.TruncateFile(utils.GetTmpFile())
+		if err != nil {
+			log.Printf("Error while creating temp file " + err.Error())
+			inputFile.Close()
+			return nil, nil, nil, err
+		}
+		return inputFile, nil, tmpFile, nil
+	}
+
 	// Get input file
 	inputEnv := os.Getenv(utils.InputFile)
 	inputFile, err := utils.GetFile(inputEnv)
@@ -1,13 +1,15 @@
 package utils
 
 import (
+	"context"
 	"encoding/csv"
 	"fmt"
 	"github.com/google/uuid"
 	"io"
 	"log"
+	"object.store/objectstore"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -75,10 +77,11 @@ func TruncateFile(filePath string) (*os.File, error) {
 }
 
 /*
-	Read output file and delete the records from DynamoDB based on 'OrderId' (HASH)
+	Read the temp file, holding the output of the records saved so far, and delete the
+	records from DynamoDB based on the hash key of the record schema
 */
 func DeleteProcessedData() {
-	outputFilePath := GetOutputFile()
+	outputFilePath := GetTmpFile()
 	if Exists(outputFilePath) {
 		outputFile, err := os.Open(outputFilePath)
 		if err != nil {
@@ -88,24 +91,22 @@ func DeleteProcessedData() {
 
 		reader := csv.NewReader(outputFile)
 		var orders []string
-		index := 0
 		for {
 			record, errRead := reader.Read()
 			if errRead == io.EOF {
-				DeleteItems(orders)
+				if len(orders) > 0 {
+					DeleteItems(orders)
+				}
 				break
 			}
-			index++
+			orders = append(orders, record[0])
 
 			// Batch to 25 records at a time
-			if index == MaxRecordsPerBatch {
+			if len(orders) == MaxRecordsPerBatch {
 				DeleteItems(orders)
 
 				// Trim data
 				orders = orders[:0]
-				index = 0
-			} else {
-				orders = append(orders, record[0])
 			}
 		}
 	}
@@ -159,17 +160,30 @@ func GetOutputDirectory() string {
 	return os.Getenv(EfsDirectoryPath) + "/" + os.Getenv(StatusKey) + "/" + "Output"
 }
 
+/*
+	Concatenate the output files of all the batches into a single S3 object
+*/
 func MoveFilesToS3() error {
-	copyCmd := fmt.Sprintf("find %s -name '*.*' -exec cat {} \\; | aws s3 cp - s3://%s/%s_Output",
-		GetOutputDirectory(), os.Getenv(S3BucketName), os.Getenv(S3Key))
-
-	_, err := exec.Command("sh", "-c", copyCmd).Output()
+	var outputFiles []string
+	err := filepath.Walk(GetOutputDirectory(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.Contains(info.Name(), ".") {
+			outputFiles = append(outputFiles, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
+	store, err := objectstore.NewClientFromEnv()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return store.UploadFiles(context.Background(), os.Getenv(S3BucketName), os.Getenv(S3Key)+"_Output", outputFiles)
 }
 
 /*
@@ -184,6 +198,46 @@ func GetTmpFile() string {
 	return fmt.Sprintf("%s/%s", dir, absoluteFileName)
 }
 
+/*
+	Get the file collecting the rejected rows, next to the temp file
+*/
+func GetRejectFile() string {
+	return GetTmpFile() + ".rejects"
+}
+
+/*
+	Upload the rejected rows of the batch, named after its split file or byte range
+*/
+func UploadRejects(name string) (string, error) {
+	store, err := objectstore.NewClientFromEnv()
+	if err != nil {
+		return "", err
+	}
+
+	key := os.Getenv(S3Key) + "_Rejects/" + name
+	return key, store.UploadFile(context.Background(), os.Getenv(S3BucketName), key, GetRejectFile())
+}
+
+/*
+	Get the file collecting the rows failing to be written to DynamoDB, next to the temp file
+*/
+func GetDeadLetterFile() string {
+	return GetTmpFile() + ".deadletters"
+}
+
+/*
+	Upload the dead letters of the batch, named after its split file or byte range
+*/
+func UploadDeadLetters(name string) (string, error) {
+	store, err := objectstore.NewClientFromEnv()
+	if err != nil {
+		return "", err
+	}
+
+	key := os.Getenv(S3Key) + "_DeadLetters/" + name
+	return key, store.UploadFile(context.Background(), os.Getenv(S3BucketName), key, GetDeadLetterFile())
+}
+
 /*
 	Equivalent to mkdirs() in unix
 */
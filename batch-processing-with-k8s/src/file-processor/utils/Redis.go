@@ -15,15 +15,28 @@ var (
 )
 
 /*
-	Remove from value from set
+	Removes a value from a set and returns the number of values left, or -1 when the value
+	was not in the set, as a single step
 */
-func RemoveFromCache(value string) error{
-	_, err := rdb.SRem(ctx, os.Getenv(StatusKey), value).Result()
+var removeAndCount = redis.NewScript(`
+if redis.call("SREM", KEYS[1], ARGV[1]) == 0 then
+	return -1
+end
+return redis.call("SCARD", KEYS[1])
+`)
+
+/*
+	Remove from value from set, reports whether this removed the last value of the set.
+	Only one of the workers removing values at the same time sees the set become empty,
+	and a worker removing its value again does not.
+*/
+func RemoveFromCache(value string) (bool, error) {
+	remaining, err := removeAndCount.Run(ctx, rdb, []string{os.Getenv(StatusKey)}, value).Int64()
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	return nil
+	return remaining == 0, nil
 }
 
 /*
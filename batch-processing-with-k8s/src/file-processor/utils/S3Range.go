@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"object.store/objectstore"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const rangeMarker = "#bytes="
+
+/*
+	Byte range of the input object, the work item of a processor when split-file runs
+	with SPLIT_MODE=range, formatted as s3://bucket/key#bytes=start-end
+*/
+type S3Range struct {
+	Bucket string
+	Key    string
+	Start  int64
+	End    int64
+}
+
+/*
+	Parses a work item, reporting false for the path of a split file on EFS
+*/
+func ParseRange(item string) (*S3Range, bool, error) {
+	if !strings.HasPrefix(item, "s3://") {
+		return nil, false, nil
+	}
+
+	location := strings.TrimPrefix(item, "s3://")
+	marker := strings.LastIndex(location, rangeMarker)
+	slash := strings.Index(location, "/")
+	if marker < 0 || slash < 0 || slash > marker {
+		return nil, true, fmt.Errorf("invalid byte range %q", item)
+	}
+
+	bounds := strings.SplitN(location[marker+len(rangeMarker):], "-", 2)
+	if len(bounds) != 2 {
+		return nil, true, fmt.Errorf("invalid byte range %q", item)
+	}
+	start, errStart := strconv.ParseInt(bounds[0], 10, 64)
+	end, errEnd := strconv.ParseInt(bounds[1], 10, 64)
+	if errStart != nil || errEnd != nil || start < 0 || end < start {
+		return nil, true, fmt.Errorf("invalid byte range %q", item)
+	}
+
+	return &S3Range{Bucket: location[:slash], Key: location[slash+1 : marker], Start: start, End: end}, true, nil
+}
+
+/*
+	Stream the range with ranged GETs
+*/
+func (r *S3Range) Open() (io.ReadCloser, error) {
+	store, err := objectstore.NewClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return store.OpenRange(context.Background(), r.Bucket, r.Key, r.Start, r.End)
+}
+
+/*
+	Read the header row of the object, the bytes before the first range
+*/
+func (r *S3Range) ReadHeader() ([]string, error) {
+	store, err := objectstore.NewClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := store.OpenRange(context.Background(), r.Bucket, r.Key, 0, r.Start)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return csv.NewReader(reader).Read()
+}
+
+/*
+	Key prefix of the output parts of the ranges, merged once all ranges are processed
+*/
+func outputPartsPrefix() string {
+	return os.Getenv(S3Key) + "_Output.parts/"
+}
+
+/*
+	Upload the output of the range as a part named after its offsets, zero padded so
+	that listing the parts returns them in the order of the input
+*/
+func (r *S3Range) UploadOutput(filePath string) error {
+	store, err := objectstore.NewClientFromEnv()
+	if err != nil {
+		return err
+	}
+
+	key := outputPartsPrefix() + r.PartName()
+	return store.UploadFile(context.Background(), os.Getenv(S3BucketName), key, filePath)
+}
+
+/*
+	Name of the range in the keys of its outputs
+*/
+func (r *S3Range) PartName() string {
+	return fmt.Sprintf("%020d-%020d", r.Start, r.End)
+}
+
+/*
+	Concatenate the output parts of all the ranges into a single S3 object and delete them
+*/
+func MergeOutputParts() error {
+	store, err := objectstore.NewClientFromEnv()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	bucket := os.Getenv(S3BucketName)
+	parts, err := store.ListKeys(ctx, bucket, outputPartsPrefix())
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return fmt.Errorf("no output parts found under s3://%s/%s", bucket, outputPartsPrefix())
+	}
+
+	log.Printf("Merging %d output parts into s3://%s/%s_Output", len(parts), bucket, os.Getenv(S3Key))
+	err = store.UploadObjects(ctx, bucket, os.Getenv(S3Key)+"_Output", parts)
+	if err != nil {
+		return err
+	}
+	return store.DeleteKeys(ctx, bucket, parts)
+}
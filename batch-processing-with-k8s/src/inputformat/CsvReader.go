@@ -0,0 +1,46 @@
+package inputformat
+
+import (
+	"encoding/csv"
+	"io"
+)
+
+type csvReader struct {
+	reader *csv.Reader
+	closer io.Closer
+	header []string
+}
+
+func newCsvReader(input io.Reader, closer io.Closer) (*csvReader, error) {
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		header = nil
+	} else if err != nil {
+		closer.Close()
+		return nil, err
+	}
+	return &csvReader{reader: reader, closer: closer, header: header}, nil
+}
+
+func (r *csvReader) Header() []string {
+	return r.header
+}
+
+func (r *csvReader) Read() ([]string, error) {
+	if r.header == nil {
+		return nil, io.EOF
+	}
+	return r.reader.Read()
+}
+
+func (r *csvReader) Line() int {
+	line, _ := r.reader.FieldPos(0)
+	return line
+}
+
+func (r *csvReader) Close() error {
+	return r.closer.Close()
+}
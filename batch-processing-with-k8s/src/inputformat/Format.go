@@ -0,0 +1,204 @@
+package inputformat
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"mime"
+	"os"
+	"strings"
+)
+
+const (
+	Csv       = "csv"
+	JsonLines = "jsonl"
+	Parquet   = "parquet"
+
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+/*
+	Encoding of an input file and the compression wrapped around it
+*/
+type Format struct {
+	Encoding    string
+	Compression string
+}
+
+func (f Format) String() string {
+	if f.Compression == "" {
+		return f.Encoding
+	}
+	return f.Encoding + "+" + f.Compression
+}
+
+/*
+	Whether the input is plain CSV, whose records can be read from any byte offset
+*/
+func (f Format) IsPlainCsv() bool {
+	return f.Encoding == Csv && f.Compression == ""
+}
+
+var (
+	encodingExtensions = map[string]string{
+		".csv":     Csv,
+		".jsonl":   JsonLines,
+		".ndjson":  JsonLines,
+		".parquet": Parquet,
+	}
+	compressionExtensions = map[string]string{
+		".gz":   Gzip,
+		".gzip": Gzip,
+		".zst":  Zstd,
+		".zstd": Zstd,
+	}
+	encodingContentTypes = map[string]string{
+		"text/csv":                       Csv,
+		"application/csv":                Csv,
+		"application/x-ndjson":           JsonLines,
+		"application/jsonl":              JsonLines,
+		"application/x-jsonlines":        JsonLines,
+		"application/vnd.apache.parquet": Parquet,
+		"application/x-parquet":          Parquet,
+	}
+	compressionContentTypes = map[string]string{
+		"application/gzip":   Gzip,
+		"application/x-gzip": Gzip,
+		"application/zstd":   Zstd,
+	}
+)
+
+/*
+	Selects the format of an input by the extensions of its name (e.g. orders.csv.gz), or
+	by its content type when the name has no known extension
+*/
+func Detect(name string, contentType string) (Format, error) {
+	format := Format{}
+	base := strings.ToLower(name[strings.LastIndex(name, "/")+1:])
+
+	for extension, compression := range compressionExtensions {
+		if strings.HasSuffix(base, extension) {
+			format.Compression = compression
+			base = strings.TrimSuffix(base, extension)
+			break
+		}
+	}
+	for extension, encoding := range encodingExtensions {
+		if strings.HasSuffix(base, extension) {
+			format.Encoding = encoding
+			break
+		}
+	}
+
+	// e.g. orders.csv uploaded as application/gzip, or an object without extension
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if format.Compression == "" {
+		format.Compression = compressionContentTypes[mediaType]
+	}
+	if format.Encoding == "" {
+		format.Encoding = encodingContentTypes[mediaType]
+	}
+
+	if format.Encoding == "" {
+		return format, fmt.Errorf("unsupported input %s (content type %q), expected csv, jsonl or parquet, optionally gzip or zstd compressed", name, contentType)
+	}
+	if format.Encoding == Parquet && format.Compression != "" {
+		return format, fmt.Errorf("unsupported input %s, parquet files are compressed internally", name)
+	}
+	return format, nil
+}
+
+/*
+	Rows of an input file. The first row is the header naming the columns of the others.
+*/
+type RecordReader interface {
+	Header() []string
+	// Returns io.EOF after the last record
+	Read() ([]string, error)
+	// Line of the input where the last record read starts, its row number for parquet
+	Line() int
+	Close() error
+}
+
+/*
+	Reads the records of a stream. Columns names the fields picked from JSON objects.
+	Parquet needs random access, use OpenFile for it.
+*/
+func NewReader(format Format, input io.Reader, columns []string) (RecordReader, error) {
+	decompressed, closer, err := decompress(format.Compression, input)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format.Encoding {
+	case Csv:
+		return newCsvReader(decompressed, closer)
+	case JsonLines:
+		return newJsonLinesReader(decompressed, closer, columns), nil
+	}
+	closer.Close()
+	return nil, fmt.Errorf("format %s cannot be streamed", format)
+}
+
+/*
+	Reads the records of a local file
+*/
+func OpenFile(format Format, path string, columns []string) (RecordReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if format.Encoding == Parquet {
+		reader, err := newParquetReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return reader, nil
+	}
+
+	reader, err := NewReader(format, file, columns)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &fileRecordReader{RecordReader: reader, file: file}, nil
+}
+
+type fileRecordReader struct {
+	RecordReader
+	file *os.File
+}
+
+func (r *fileRecordReader) Close() error {
+	r.RecordReader.Close()
+	return r.file.Close()
+}
+
+func decompress(compression string, input io.Reader) (io.Reader, io.Closer, error) {
+	switch compression {
+	case Gzip:
+		reader, err := gzip.NewReader(input)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, reader, nil
+	case Zstd:
+		reader, err := zstd.NewReader(input)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, closerFunc(reader.Close), nil
+	}
+	return input, closerFunc(func() {}), nil
+}
+
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
@@ -0,0 +1,92 @@
+package inputformat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+	Reads one JSON object per line. The header is the list of columns, and the fields of
+	every object are matched to it ignoring case; missing and null fields are empty,
+	nested objects and arrays are kept as JSON.
+*/
+type jsonLinesReader struct {
+	scanner *bufio.Scanner
+	closer  io.Closer
+	header  []string
+	line    int
+}
+
+func newJsonLinesReader(input io.Reader, closer io.Closer, columns []string) *jsonLinesReader {
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &jsonLinesReader{scanner: scanner, closer: closer, header: columns}
+}
+
+func (r *jsonLinesReader) Header() []string {
+	return r.header
+}
+
+func (r *jsonLinesReader) Read() ([]string, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(line, &fields); err != nil {
+			return nil, fmt.Errorf("line %d: %v", r.line, err)
+		}
+		normalized := make(map[string]json.RawMessage, len(fields))
+		for name, value := range fields {
+			normalized[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+
+		record := make([]string, len(r.header))
+		for i, column := range r.header {
+			value, err := jsonValue(normalized[strings.ToLower(strings.TrimSpace(column))])
+			if err != nil {
+				return nil, fmt.Errorf("line %d, field %q: %v", r.line, column, err)
+			}
+			record[i] = value
+		}
+		return record, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func jsonValue(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	switch raw[0] {
+	case '"':
+		var value string
+		err := json.Unmarshal(raw, &value)
+		return value, err
+	case '{', '[':
+		var compacted bytes.Buffer
+		err := json.Compact(&compacted, raw)
+		return compacted.String(), err
+	}
+	// numbers and booleans as written
+	return string(raw), nil
+}
+
+func (r *jsonLinesReader) Line() int {
+	return r.line
+}
+
+func (r *jsonLinesReader) Close() error {
+	return r.closer.Close()
+}
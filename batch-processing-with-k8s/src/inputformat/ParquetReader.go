@@ -0,0 +1,99 @@
+package inputformat
+
+import (
+	"github.com/parquet-go/parquet-go"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	Reads the rows of a parquet file. The header holds the leaf columns, nested ones named
+	by their path joined with dots, and repeated values are joined with commas.
+*/
+type parquetReader struct {
+	file   *os.File
+	reader *parquet.Reader
+	header []string
+	rows   []parquet.Row
+	next   int
+	count  int
+	row    int
+}
+
+func newParquetReader(file *os.File) (*parquetReader, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	parquetFile, err := parquet.OpenFile(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	var header []string
+	for _, path := range parquetFile.Schema().Columns() {
+		header = append(header, strings.Join(path, "."))
+	}
+
+	return &parquetReader{
+		file:   file,
+		reader: parquet.NewReader(parquetFile),
+		header: header,
+		rows:   make([]parquet.Row, 256),
+	}, nil
+}
+
+func (r *parquetReader) Header() []string {
+	return r.header
+}
+
+func (r *parquetReader) Read() ([]string, error) {
+	if r.next == r.count {
+		count, err := r.reader.ReadRows(r.rows)
+		if count == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return nil, err
+		}
+		r.next, r.count = 0, count
+	}
+
+	row := r.rows[r.next]
+	r.next++
+	r.row++
+
+	record := make([]string, len(r.header))
+	for _, value := range row {
+		column := value.Column()
+		if column < 0 || column >= len(record) || value.IsNull() {
+			continue
+		}
+		if record[column] != "" {
+			record[column] += ","
+		}
+		record[column] += parquetValue(value)
+	}
+	return record, nil
+}
+
+func parquetValue(value parquet.Value) string {
+	switch value.Kind() {
+	case parquet.Float:
+		return strconv.FormatFloat(float64(value.Float()), 'g', -1, 32)
+	case parquet.Double:
+		return strconv.FormatFloat(value.Double(), 'g', -1, 64)
+	}
+	return value.String()
+}
+
+func (r *parquetReader) Line() int {
+	return r.row
+}
+
+func (r *parquetReader) Close() error {
+	r.reader.Close()
+	return r.file.Close()
+}
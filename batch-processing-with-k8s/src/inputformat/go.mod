@@ -0,0 +1,8 @@
+module input.format/inputformat
+
+go 1.16
+
+require (
+	github.com/klauspost/compress v1.17.4
+	github.com/parquet-go/parquet-go v0.20.0
+)
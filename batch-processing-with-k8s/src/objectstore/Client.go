@@ -0,0 +1,408 @@
+package objectstore
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	S3Endpoint          = "S3_ENDPOINT"
+	S3ForcePathStyle    = "S3_FORCE_PATH_STYLE"
+	S3MaxRetries        = "S3_MAX_RETRIES"
+	S3PartSizeMiB       = "S3_PART_SIZE_MIB"
+	S3UploadConcurrency = "S3_UPLOAD_CONCURRENCY"
+
+	defaultMaxRetries        = 5
+	defaultPartSizeMiB       = 16
+	defaultUploadConcurrency = 4
+)
+
+/*
+	S3 client streaming objects through the SDK, so that no image needs the aws CLI
+	and keys are never interpreted by a shell
+*/
+type Client struct {
+	svc        s3iface.S3API
+	uploader   *s3manager.Uploader
+	maxRetries int
+}
+
+/*
+	Settings of the client, read from the environment by ConfigFromEnv
+*/
+type Config struct {
+	// Endpoint of an S3 compatible store (e.g. http://localhost:9000), empty for AWS
+	Endpoint string
+
+	// Address buckets in the path instead of the host name, needed by most stand-ins
+	ForcePathStyle bool
+
+	// Retries of a failed request, also used to resume interrupted downloads
+	MaxRetries int
+
+	// Part size and parallel parts of multipart uploads
+	PartSizeMiB       int
+	UploadConcurrency int
+}
+
+/*
+	Reads S3_ENDPOINT, S3_FORCE_PATH_STYLE (default true when an endpoint is set),
+	S3_MAX_RETRIES, S3_PART_SIZE_MIB and S3_UPLOAD_CONCURRENCY
+*/
+func ConfigFromEnv() (Config, error) {
+	config := Config{
+		Endpoint:          strings.TrimSpace(os.Getenv(S3Endpoint)),
+		MaxRetries:        defaultMaxRetries,
+		PartSizeMiB:       defaultPartSizeMiB,
+		UploadConcurrency: defaultUploadConcurrency,
+	}
+	config.ForcePathStyle = config.Endpoint != ""
+
+	if value := os.Getenv(S3ForcePathStyle); value != "" {
+		forcePathStyle, err := strconv.ParseBool(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid %s %q", S3ForcePathStyle, value)
+		}
+		config.ForcePathStyle = forcePathStyle
+	}
+
+	for env, target := range map[string]*int{
+		S3MaxRetries:        &config.MaxRetries,
+		S3PartSizeMiB:       &config.PartSizeMiB,
+		S3UploadConcurrency: &config.UploadConcurrency,
+	} {
+		if value := os.Getenv(env); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				return config, fmt.Errorf("invalid %s %q", env, value)
+			}
+			*target = parsed
+		}
+	}
+
+	// S3 refuses parts smaller than 5 MiB
+	if config.PartSizeMiB < 5 {
+		config.PartSizeMiB = 5
+	}
+	if config.UploadConcurrency < 1 {
+		config.UploadConcurrency = 1
+	}
+	return config, nil
+}
+
+/*
+	Creates a client configured from the environment
+*/
+func NewClientFromEnv() (*Client, error) {
+	config, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(config)
+}
+
+/*
+	Creates a client using the shared AWS configuration and credentials
+*/
+func NewClient(config Config) (*Client, error) {
+	awsConfig := aws.NewConfig().
+		WithMaxRetries(config.MaxRetries).
+		WithS3ForcePathStyle(config.ForcePathStyle)
+	if config.Endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(config.Endpoint)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	svc := s3.New(sess)
+	uploader := s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+		u.PartSize = int64(config.PartSizeMiB) * 1024 * 1024
+		u.Concurrency = config.UploadConcurrency
+	})
+	return &Client{svc: svc, uploader: uploader, maxRetries: config.MaxRetries}, nil
+}
+
+/*
+	Size and content type of an object
+*/
+type ObjectInfo struct {
+	Size        int64
+	ContentType string
+}
+
+/*
+	Reads the metadata of an object
+*/
+func (c *Client) Stat(ctx context.Context, bucket string, key string) (*ObjectInfo, error) {
+	output, err := c.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("head of s3://%s/%s failed: %v", bucket, key, err)
+	}
+	return &ObjectInfo{Size: aws.Int64Value(output.ContentLength), ContentType: aws.StringValue(output.ContentType)}, nil
+}
+
+/*
+	Opens an object for streaming. A download interrupted mid-way is resumed from the
+	last byte read, up to the configured number of retries.
+*/
+func (c *Client) Open(ctx context.Context, bucket string, key string) (io.ReadCloser, error) {
+	reader := &objectReader{ctx: ctx, client: c, bucket: bucket, key: key}
+	if err := reader.open(); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+/*
+	Opens the bytes [start, end) of an object for streaming, resumed like Open
+*/
+func (c *Client) OpenRange(ctx context.Context, bucket string, key string, start int64, end int64) (io.ReadCloser, error) {
+	if end <= start {
+		// S3 has no way to ask for an empty range
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+
+	reader := &objectReader{ctx: ctx, client: c, bucket: bucket, key: key, offset: start, end: end}
+	if err := reader.open(); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+/*
+	Downloads an object to a local file, replacing it
+*/
+func (c *Client) Download(ctx context.Context, bucket string, key string, filePath string) error {
+	reader, err := c.Open(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return fmt.Errorf("download of s3://%s/%s failed: %v", bucket, key, err)
+	}
+	return file.Close()
+}
+
+/*
+	Uploads a stream of unknown length, in parts when it is larger than the part size
+*/
+func (c *Client) Upload(ctx context.Context, bucket string, key string, body io.Reader) error {
+	_, err := c.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	})
+	if err != nil {
+		return fmt.Errorf("upload to s3://%s/%s failed: %v", bucket, key, err)
+	}
+	return nil
+}
+
+/*
+	Uploads a local file
+*/
+func (c *Client) UploadFile(ctx context.Context, bucket string, key string, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return c.Upload(ctx, bucket, key, file)
+}
+
+/*
+	Uploads the concatenation of local files, streamed one after the other
+*/
+func (c *Client) UploadFiles(ctx context.Context, bucket string, key string, filePaths []string) error {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		for _, filePath := range filePaths {
+			file, err := os.Open(filePath)
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(pipeWriter, file)
+			file.Close()
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+		}
+		pipeWriter.Close()
+	}()
+
+	err := c.Upload(ctx, bucket, key, pipeReader)
+	pipeReader.Close()
+	return err
+}
+
+/*
+	Uploads the concatenation of objects, streamed one after the other
+*/
+func (c *Client) UploadObjects(ctx context.Context, bucket string, key string, sourceKeys []string) error {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		for _, sourceKey := range sourceKeys {
+			reader, err := c.Open(ctx, bucket, sourceKey)
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(pipeWriter, reader)
+			reader.Close()
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+		}
+		pipeWriter.Close()
+	}()
+
+	err := c.Upload(ctx, bucket, key, pipeReader)
+	pipeReader.Close()
+	return err
+}
+
+/*
+	Lists the keys starting with prefix, in lexical order
+*/
+func (c *Client) ListKeys(ctx context.Context, bucket string, prefix string) ([]string, error) {
+	var keys []string
+	err := c.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list of s3://%s/%s failed: %v", bucket, prefix, err)
+	}
+	return keys, nil
+}
+
+/*
+	Deletes objects, a thousand keys per request
+*/
+func (c *Client) DeleteKeys(ctx context.Context, bucket string, keys []string) error {
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > 1000 {
+			batch = batch[:1000]
+		}
+		keys = keys[len(batch):]
+
+		objects := make([]*s3.ObjectIdentifier, 0, len(batch))
+		for _, key := range batch {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		output, err := c.svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("delete of objects in s3://%s failed: %v", bucket, err)
+		}
+		if len(output.Errors) > 0 {
+			return fmt.Errorf("delete of s3://%s/%s failed: %s", bucket, aws.StringValue(output.Errors[0].Key), aws.StringValue(output.Errors[0].Message))
+		}
+	}
+	return nil
+}
+
+/*
+	Reader of an object body that reopens the object at its current offset when
+	the connection breaks
+*/
+type objectReader struct {
+	ctx     context.Context
+	client  *Client
+	bucket  string
+	key     string
+	body    io.ReadCloser
+	offset  int64
+	end     int64 // exclusive end of a ranged read, 0 to read to the end of the object
+	retries int
+}
+
+func (r *objectReader) open() error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key),
+	}
+	if r.end > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", r.offset, r.end-1))
+	} else if r.offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", r.offset))
+	}
+
+	output, err := r.client.svc.GetObjectWithContext(r.ctx, input)
+	if err != nil {
+		return fmt.Errorf("get of s3://%s/%s failed: %v", r.bucket, r.key, err)
+	}
+	r.body = output.Body
+	return nil
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if r.end > 0 && r.offset >= r.end && err != nil {
+			return n, io.EOF
+		}
+		if err == nil || err == io.EOF || r.retries >= r.client.maxRetries || r.ctx.Err() != nil {
+			return n, err
+		}
+
+		r.retries++
+		log.Printf("Resuming s3://%s/%s at byte %d after %s", r.bucket, r.key, r.offset, err.Error())
+		r.body.Close()
+		if openErr := r.open(); openErr != nil {
+			return n, openErr
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *objectReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,5 @@
+module object.store/objectstore
+
+go 1.16
+
+require github.com/aws/aws-sdk-go v1.38.25
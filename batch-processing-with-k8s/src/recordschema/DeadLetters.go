@@ -0,0 +1,46 @@
+package recordschema
+
+import (
+	"encoding/csv"
+	"io"
+)
+
+/*
+	Writes the rows that could not be written to DynamoDB as CSV under the header of the
+	input, so that the file can be processed again as an input. The header row is written
+	with the first row, so that a file without dead letters stays empty.
+*/
+type DeadLetterWriter struct {
+	writer *csv.Writer
+	header []string
+	count  int
+}
+
+func NewDeadLetterWriter(w io.Writer, header []string) *DeadLetterWriter {
+	return &DeadLetterWriter{writer: csv.NewWriter(w), header: header}
+}
+
+/*
+	Writes the rows of a failed batch
+*/
+func (d *DeadLetterWriter) Write(records [][]string) error {
+	if d.count == 0 && len(records) > 0 {
+		if err := d.writer.Write(d.header); err != nil {
+			return err
+		}
+	}
+	d.count += len(records)
+	return d.writer.WriteAll(records)
+}
+
+/*
+	Number of rows written so far
+*/
+func (d *DeadLetterWriter) Count() int {
+	return d.count
+}
+
+func (d *DeadLetterWriter) Flush() error {
+	d.writer.Flush()
+	return d.writer.Error()
+}
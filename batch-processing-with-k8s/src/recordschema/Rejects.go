@@ -0,0 +1,59 @@
+package recordschema
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+/*
+	Writes the rows failing the schema as CSV, each with its position in the input and
+	the reason it was rejected ahead of its fields. The header row is written with the
+	first rejected row, so that a file without rejects stays empty.
+*/
+type RejectWriter struct {
+	writer   *csv.Writer
+	header   []string
+	position string
+	count    int
+}
+
+/*
+	Rows are identified by their line number in the input
+*/
+func NewRejectWriter(w io.Writer, header []string) *RejectWriter {
+	return &RejectWriter{writer: csv.NewWriter(w), header: header, position: "line"}
+}
+
+/*
+	Rows are identified by the byte offset of their start in the input, for rows read
+	from a byte range whose first line number is unknown
+*/
+func NewOffsetRejectWriter(w io.Writer, header []string) *RejectWriter {
+	return &RejectWriter{writer: csv.NewWriter(w), header: header, position: "offset"}
+}
+
+/*
+	Writes a rejected row at the given line number or byte offset
+*/
+func (r *RejectWriter) Reject(position int64, reason string, record []string) error {
+	if r.count == 0 {
+		if err := r.writer.Write(append([]string{r.position, "reason"}, r.header...)); err != nil {
+			return err
+		}
+	}
+	r.count++
+	return r.writer.Write(append([]string{strconv.FormatInt(position, 10), reason}, record...))
+}
+
+/*
+	Number of rows rejected so far
+*/
+func (r *RejectWriter) Count() int {
+	return r.count
+}
+
+func (r *RejectWriter) Flush() error {
+	r.writer.Flush()
+	return r.writer.Error()
+}
@@ -0,0 +1,374 @@
+package recordschema
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	RecordSchema = "RECORD_SCHEMA"
+
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeFloat  = "float"
+	TypeBool   = "bool"
+
+	AttributeTypeString = "S"
+	AttributeTypeNumber = "N"
+	AttributeTypeBool   = "BOOL"
+
+	KeyHash = "hash"
+)
+
+// Layout of the sales order files, used when RECORD_SCHEMA is not set
+//go:embed sales-order-schema.json
+var defaultSchema []byte
+
+/*
+	Description of the columns of the input files and of the DynamoDB items they map to
+*/
+type Schema struct {
+	// DynamoDB table receiving the items
+	Table string `json:"table"`
+
+	// Attribute set to a generated UUID on every item and returned per key, empty for none
+	ConfirmationAttribute string `json:"confirmationAttribute"`
+
+	Columns []Column `json:"columns"`
+
+	// Consistency checks between columns, rows failing one are rejected
+	Checks []Check `json:"checks"`
+}
+
+/*
+	Column of the input, matched by its header name
+*/
+type Column struct {
+	Name string `json:"name"`
+
+	// string, int, float or bool, checked before the item is written
+	Type string `json:"type"`
+
+	// Rows with an empty value are rejected
+	Required bool `json:"required"`
+
+	// Attribute of the item, the column name when empty
+	Attribute string `json:"attribute"`
+
+	// DynamoDB type of the attribute, N for int and float, BOOL for bool and S for string
+	// when empty. S stores values of any type as they are written in the input.
+	AttributeType string `json:"attributeType"`
+
+	// The column is checked but not written to the item
+	Omit bool `json:"omit"`
+
+	// "hash" for the partition key of the table, exactly one column has it
+	Key string `json:"key"`
+
+	// Bounds of int and float values
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+
+	// Go time layout (e.g. "1/2/2006") values of the column must match
+	DateFormat string `json:"dateFormat"`
+}
+
+/*
+	Loads the schema file named by RECORD_SCHEMA, or the sales order schema when unset
+*/
+func LoadFromEnv() (*Schema, error) {
+	path := strings.TrimSpace(os.Getenv(RecordSchema))
+	if path == "" {
+		return Parse(defaultSchema)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", RecordSchema, err)
+	}
+	schema, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %s: %v", RecordSchema, path, err)
+	}
+	return schema, nil
+}
+
+/*
+	Like LoadFromEnv, panics when the schema cannot be loaded
+*/
+func MustLoadFromEnv() *Schema {
+	schema, err := LoadFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+/*
+	Parses and checks a JSON schema
+*/
+func Parse(data []byte) (*Schema, error) {
+	schema := &Schema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, err
+	}
+	if err := schema.validate(); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func (s *Schema) validate() error {
+	if strings.TrimSpace(s.Table) == "" {
+		return fmt.Errorf("table is required")
+	}
+	if len(s.Columns) == 0 {
+		return fmt.Errorf("no columns")
+	}
+
+	names := map[string]bool{}
+	attributes := map[string]bool{s.ConfirmationAttribute: s.ConfirmationAttribute != ""}
+	keys := 0
+	for i := range s.Columns {
+		column := &s.Columns[i]
+		column.Name = strings.TrimSpace(column.Name)
+		if column.Name == "" {
+			return fmt.Errorf("column %d has no name", i+1)
+		}
+		if column.Attribute == "" {
+			column.Attribute = column.Name
+		}
+		if column.Type == "" {
+			column.Type = TypeString
+		}
+
+		defaultAttributeType := AttributeTypeString
+		switch column.Type {
+		case TypeString:
+		case TypeInt, TypeFloat:
+			defaultAttributeType = AttributeTypeNumber
+		case TypeBool:
+			defaultAttributeType = AttributeTypeBool
+		default:
+			return fmt.Errorf("column %q has unknown type %q", column.Name, column.Type)
+		}
+		if column.AttributeType == "" {
+			column.AttributeType = defaultAttributeType
+		}
+		if column.AttributeType != defaultAttributeType && column.AttributeType != AttributeTypeString {
+			return fmt.Errorf("column %q of type %s cannot be stored as attribute type %q", column.Name, column.Type, column.AttributeType)
+		}
+		switch column.Key {
+		case "":
+		case KeyHash:
+			keys++
+			if column.Type != TypeString {
+				return fmt.Errorf("key column %q must be a string", column.Name)
+			}
+			if column.Omit {
+				return fmt.Errorf("key column %q cannot be omitted", column.Name)
+			}
+			column.Required = true
+		default:
+			return fmt.Errorf("column %q has unknown key role %q", column.Name, column.Key)
+		}
+
+		if names[column.Name] {
+			return fmt.Errorf("duplicate column %q", column.Name)
+		}
+		if attributes[column.Attribute] {
+			return fmt.Errorf("duplicate attribute %q", column.Attribute)
+		}
+		names[column.Name] = true
+		attributes[column.Attribute] = true
+	}
+
+	if keys != 1 {
+		return fmt.Errorf("exactly one column needs key %q, found %d", KeyHash, keys)
+	}
+
+	numericAttributes := map[string]bool{}
+	for _, column := range s.Columns {
+		if column.Type == TypeInt || column.Type == TypeFloat {
+			numericAttributes[column.Attribute] = true
+		} else if column.Min != nil || column.Max != nil {
+			return fmt.Errorf("column %q has bounds but is not an int or float", column.Name)
+		}
+	}
+	for i := range s.Checks {
+		if err := s.Checks[i].compile(numericAttributes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	Attribute of the partition key of the table
+*/
+func (s *Schema) HashKey() string {
+	for _, column := range s.Columns {
+		if column.Key == KeyHash {
+			return column.Attribute
+		}
+	}
+	return ""
+}
+
+/*
+	Header names of the columns, the fields read from inputs without a header row
+*/
+func (s *Schema) ColumnNames() []string {
+	names := make([]string, 0, len(s.Columns))
+	for _, column := range s.Columns {
+		names = append(names, column.Name)
+	}
+	return names
+}
+
+/*
+	Maps rows to items by the position of each column in a header row
+*/
+type Mapper struct {
+	schema  *Schema
+	indexes []int // position of each schema column in the rows, -1 when absent
+	key     int
+}
+
+/*
+	Item of a row, keyed by the value of its hash key column
+*/
+type Item struct {
+	Key        string
+	Attributes map[string]*dynamodb.AttributeValue
+}
+
+/*
+	Creates a mapper for the header row of a file. Header names are matched ignoring case
+	and surrounding spaces, required columns missing from the header are an error and
+	columns unknown to the schema are ignored.
+*/
+func (s *Schema) NewMapper(header []string) (*Mapper, error) {
+	positions := map[string]int{}
+	for i, name := range header {
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		positions[normalizeName(name)] = i
+	}
+
+	mapper := &Mapper{schema: s, indexes: make([]int, len(s.Columns))}
+	var missing []string
+	for i, column := range s.Columns {
+		index, ok := positions[normalizeName(column.Name)]
+		if !ok {
+			index = -1
+			if column.Required {
+				missing = append(missing, column.Name)
+			}
+		}
+		mapper.indexes[i] = index
+		if column.Key == KeyHash {
+			mapper.key = i
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("header has no column %s", strings.Join(missing, ", "))
+	}
+	return mapper, nil
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+/*
+	Maps a row to an item. Empty optional values are left out of the item, except for
+	strings which are stored empty. The error of a row failing a rule of the schema is
+	the reason it is rejected.
+*/
+func (m *Mapper) Map(record []string) (*Item, error) {
+	item := &Item{Attributes: map[string]*dynamodb.AttributeValue{}}
+	numbers := map[string]float64{}
+	for i := range m.schema.Columns {
+		column := &m.schema.Columns[i]
+		value := ""
+		if index := m.indexes[i]; index >= 0 && index < len(record) {
+			value = record[index]
+		}
+
+		if strings.TrimSpace(value) == "" {
+			if column.Required {
+				return nil, fmt.Errorf("column %q is required", column.Name)
+			}
+			if column.Type != TypeString || m.indexes[i] < 0 {
+				continue
+			}
+		}
+
+		attribute, err := attributeValue(column.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: %v", column.Name, err)
+		}
+		var number float64
+		if attribute.N != nil {
+			number, _ = strconv.ParseFloat(*attribute.N, 64)
+			numbers[column.Attribute] = number
+		}
+		if strings.TrimSpace(value) != "" {
+			if err := column.checkValue(value, number, attribute.N != nil); err != nil {
+				return nil, fmt.Errorf("column %q: %v", column.Name, err)
+			}
+		}
+
+		if column.Omit {
+			continue
+		}
+		if column.AttributeType == AttributeTypeString && attribute.S == nil {
+			attribute = &dynamodb.AttributeValue{S: aws.String(strings.TrimSpace(value))}
+		}
+		item.Attributes[column.Attribute] = attribute
+		if i == m.key {
+			item.Key = value
+		}
+	}
+
+	for i := range m.schema.Checks {
+		if err := m.schema.Checks[i].evaluate(numbers); err != nil {
+			return nil, err
+		}
+	}
+	return item, nil
+}
+
+func attributeValue(columnType string, value string) (*dynamodb.AttributeValue, error) {
+	switch columnType {
+	case TypeInt:
+		value = strings.TrimSpace(value)
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, fmt.Errorf("%q is not an integer", value)
+		}
+		return &dynamodb.AttributeValue{N: aws.String(value)}, nil
+	case TypeFloat:
+		value = strings.TrimSpace(value)
+		if parsed, err := strconv.ParseFloat(value, 64); err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return &dynamodb.AttributeValue{N: aws.String(value)}, nil
+	case TypeBool:
+		parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", value)
+		}
+		return &dynamodb.AttributeValue{BOOL: aws.Bool(parsed)}, nil
+	}
+	return &dynamodb.AttributeValue{S: aws.String(value)}, nil
+}
@@ -0,0 +1,295 @@
+package recordschema
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const defaultTolerance = 0.01
+
+/*
+	Consistency check between the numeric columns of a row, e.g.
+	"TotalRevenue == UnitSold * UnitPrice", naming columns by their attribute
+*/
+type Check struct {
+	Expression string `json:"expression"`
+
+	// Largest difference for == and != comparisons, 0.01 when unset
+	Tolerance *float64 `json:"tolerance"`
+
+	compiled *comparison
+}
+
+/*
+	Checks the min, max and date format rules of a non empty value
+*/
+func (c *Column) checkValue(value string, number float64, isNumber bool) error {
+	if isNumber {
+		if c.Min != nil && number < *c.Min {
+			return fmt.Errorf("%s is below the minimum %s", strings.TrimSpace(value), formatNumber(*c.Min))
+		}
+		if c.Max != nil && number > *c.Max {
+			return fmt.Errorf("%s is above the maximum %s", strings.TrimSpace(value), formatNumber(*c.Max))
+		}
+	}
+	if c.DateFormat != "" {
+		if _, err := time.Parse(c.DateFormat, strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("%q does not match the date format %q", value, c.DateFormat)
+		}
+	}
+	return nil
+}
+
+func (c *Check) compile(numericAttributes map[string]bool) error {
+	parser := &expressionParser{tokens: tokenize(c.Expression)}
+	compiled, err := parser.parseComparison()
+	if err == nil && parser.position < len(parser.tokens) {
+		err = fmt.Errorf("unexpected %q", parser.tokens[parser.position])
+	}
+	if err != nil {
+		return fmt.Errorf("check %q: %v", c.Expression, err)
+	}
+
+	for _, attribute := range compiled.attributes() {
+		if !numericAttributes[attribute] {
+			return fmt.Errorf("check %q: %s is not the attribute of an int or float column", c.Expression, attribute)
+		}
+	}
+	c.compiled = compiled
+	return nil
+}
+
+/*
+	Evaluates the check, skipped when a column it uses is empty
+*/
+func (c *Check) evaluate(numbers map[string]float64) error {
+	for _, attribute := range c.compiled.attributes() {
+		if _, ok := numbers[attribute]; !ok {
+			return nil
+		}
+	}
+
+	left, right := c.compiled.left.eval(numbers), c.compiled.right.eval(numbers)
+	tolerance := defaultTolerance
+	if c.Tolerance != nil {
+		tolerance = *c.Tolerance
+	}
+
+	var holds bool
+	switch c.compiled.operator {
+	case "==":
+		holds = math.Abs(left-right) <= tolerance
+	case "!=":
+		holds = math.Abs(left-right) > tolerance
+	case "<":
+		holds = left < right
+	case "<=":
+		holds = left <= right
+	case ">":
+		holds = left > right
+	case ">=":
+		holds = left >= right
+	}
+	if !holds {
+		return fmt.Errorf("check %s failed: %s %s %s", c.Expression, formatNumber(left), c.compiled.operator, formatNumber(right))
+	}
+	return nil
+}
+
+func formatNumber(value float64) string {
+	return strconv.FormatFloat(value, 'g', 12, 64)
+}
+
+type comparison struct {
+	left, right expression
+	operator    string
+}
+
+func (c *comparison) attributes() []string {
+	return append(c.left.attributes(nil), c.right.attributes(nil)...)
+}
+
+/*
+	Arithmetic over attributes and numbers
+*/
+type expression interface {
+	eval(numbers map[string]float64) float64
+	attributes(names []string) []string
+}
+
+type number float64
+
+func (n number) eval(map[string]float64) float64   { return float64(n) }
+func (n number) attributes(names []string) []string { return names }
+
+type attribute string
+
+func (a attribute) eval(numbers map[string]float64) float64 { return numbers[string(a)] }
+func (a attribute) attributes(names []string) []string       { return append(names, string(a)) }
+
+type negation struct {
+	operand expression
+}
+
+func (n negation) eval(numbers map[string]float64) float64 { return -n.operand.eval(numbers) }
+func (n negation) attributes(names []string) []string       { return n.operand.attributes(names) }
+
+type operation struct {
+	left, right expression
+	operator    byte
+}
+
+func (o operation) eval(numbers map[string]float64) float64 {
+	left, right := o.left.eval(numbers), o.right.eval(numbers)
+	switch o.operator {
+	case '+':
+		return left + right
+	case '-':
+		return left - right
+	case '*':
+		return left * right
+	}
+	return left / right
+}
+
+func (o operation) attributes(names []string) []string {
+	return o.right.attributes(o.left.attributes(names))
+}
+
+/*
+	Splits an expression into numbers, identifiers, operators and parentheses
+*/
+func tokenize(text string) []string {
+	var tokens []string
+	for i := 0; i < len(text); {
+		r := rune(text[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			start := i
+			for i < len(text) && (unicode.IsDigit(rune(text[i])) || text[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, text[start:i])
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(text) && (unicode.IsLetter(rune(text[i])) || unicode.IsDigit(rune(text[i])) || text[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, text[start:i])
+		case strings.HasPrefix(text[i:], "==") || strings.HasPrefix(text[i:], "!=") || strings.HasPrefix(text[i:], "<=") || strings.HasPrefix(text[i:], ">="):
+			tokens = append(tokens, text[i:i+2])
+			i += 2
+		default:
+			tokens = append(tokens, text[i:i+1])
+			i++
+		}
+	}
+	return tokens
+}
+
+type expressionParser struct {
+	tokens   []string
+	position int
+}
+
+func (p *expressionParser) peek() string {
+	if p.position < len(p.tokens) {
+		return p.tokens[p.position]
+	}
+	return ""
+}
+
+func (p *expressionParser) parseComparison() (*comparison, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	operator := p.peek()
+	switch operator {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.position++
+	default:
+		return nil, fmt.Errorf("expected a comparison, found %q", operator)
+	}
+
+	right, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	return &comparison{left: left, right: right, operator: operator}, nil
+}
+
+func (p *expressionParser) parseSum() (expression, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		operator := p.peek()[0]
+		p.position++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = operation{left: left, right: right, operator: operator}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) parseProduct() (expression, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "*" || p.peek() == "/" {
+		operator := p.peek()[0]
+		p.position++
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = operation{left: left, right: right, operator: operator}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) parseFactor() (expression, error) {
+	token := p.peek()
+	p.position++
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end")
+	case token == "-":
+		operand, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return negation{operand: operand}, nil
+	case token == "(":
+		inner, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("expected ), found %q", p.peek())
+		}
+		p.position++
+		return inner, nil
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token)
+		}
+		return number(value), nil
+	case unicode.IsLetter(rune(token[0])) || token[0] == '_':
+		return attribute(token), nil
+	}
+	return nil, fmt.Errorf("unexpected %q", token)
+}
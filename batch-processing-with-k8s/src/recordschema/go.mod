@@ -0,0 +1,5 @@
+module record.schema/recordschema
+
+go 1.16
+
+require github.com/aws/aws-sdk-go v1.38.25
@@ -3,6 +3,18 @@ module single.threaded.processor/main
 go 1.16
 
 require (
+	dynamo.writer/dynamowriter v0.0.0
 	github.com/aws/aws-sdk-go v1.38.25
-	github.com/google/uuid v1.2.0
+	github.com/google/uuid v1.3.0
+	input.format/inputformat v0.0.0
+	object.store/objectstore v0.0.0
+	record.schema/recordschema v0.0.0
 )
+
+replace dynamo.writer/dynamowriter => ../dynamowriter
+
+replace input.format/inputformat => ../inputformat
+
+replace object.store/objectstore => ../objectstore
+
+replace record.schema/recordschema => ../recordschema
@@ -1,32 +1,45 @@
 package main
 
 import (
-	"encoding/csv"
+	"context"
+	"dynamo.writer/dynamowriter"
 	"fmt"
+	"input.format/inputformat"
 	"io"
 	"log"
+	"object.store/objectstore"
 	"os"
-	"os/exec"
+	"record.schema/recordschema"
 	"single.threaded.processor/main/utils"
-	"strings"
 )
 
 /*
 	Entry point for batch file processor
 */
 func main() {
-	if !strings.HasSuffix(os.Getenv(utils.S3Key), "csv") {
-		fmt.Println("Only CSV file formats are supported")
+	info, err := utils.StatInputFile()
+	if err != nil {
+		failure("Error while reading the inputFile metadata " + err.Error())
+	}
+
+	// Inputs of an unsupported format are skipped
+	format, err := inputformat.Detect(os.Getenv(utils.S3Key), info.ContentType)
+	if err != nil {
+		fmt.Println(err.Error())
 		return
 	}
+	log.Printf("Reading %s input", format)
 
-	tolerated := utils.IsErrorTolerated()
-	inputFile, outputFile, err := initialize()
+	budget, err := dynamowriter.GetErrorBudget()
+	if err != nil {
+		failure("Pre-requisites failed unable to proceed further " + err.Error())
+	}
+	reader, outputFile, err := initialize(format)
 	if err != nil {
 		failure("Pre-requisites failed unable to proceed further " + err.Error())
 	}
-	if inputFile != nil {
-		defer inputFile.Close()
+	if reader != nil {
+		defer reader.Close()
 	}
 	if outputFile != nil {
 		defer outputFile.Close()
@@ -34,67 +47,129 @@ func main() {
 
 	// Start parsing the inputFile
 	totalRecords := 0
-	reader := csv.NewReader(inputFile)
-	var records []*utils.Record
-	index := 0
+	var records []*recordschema.Item
+	var rows [][]string
+
+	// Map the rows by the column names of the first row header
+	mapper, err := utils.NewRecordMapper(reader.Header())
+	if err != nil {
+		failure("Input does not match the record schema " + err.Error())
+	}
+
+	// Rows failing the schema are written to the reject file instead
+	rejectFile, err := utils.TruncateFile(utils.GetRejectFile())
+	if err != nil {
+		failure("Error while creating reject file " + err.Error())
+	}
+	defer rejectFile.Close()
+	rejects := recordschema.NewRejectWriter(rejectFile, reader.Header())
+
+	// Rows failing to be written to DynamoDB are written to the dead letter file
+	deadLetterFile, err := utils.TruncateFile(utils.GetDeadLetterFile())
+	if err != nil {
+		failure("Error while creating dead letter file " + err.Error())
+	}
+	defer deadLetterFile.Close()
+	deadLetters := recordschema.NewDeadLetterWriter(deadLetterFile, reader.Header())
+
+	// Batches are saved in DynamoDB by a pool of writers
+	pool, err := dynamowriter.NewWriterPool(utils.NewBatchWriter(), dynamowriter.NewBudgetHandler(budget, deadLetters, func(response map[string]string) error {
+		return utils.AppendFile(response, outputFile)
+	}))
+	if err != nil {
+		failure("Pre-requisites failed unable to proceed further " + err.Error())
+	}
 
-	// Skip first row header
-	record, errRead := reader.Read()
 	for {
-		record, errRead = reader.Read()
+		record, errRead := reader.Read()
 		if errRead == io.EOF {
 			if len(records) > 0 {
-				processRecords(records, tolerated, outputFile)
+				err = pool.Submit(&dynamowriter.Batch{Items: records, Rows: rows})
+				if err != nil {
+					failure(err.Error())
+				}
+			}
+			err = pool.Close()
+			if err != nil {
+				failure(err.Error())
+			}
+			err = budget.Check()
+			if err != nil {
+				failure(err.Error())
 			}
 
-			success()
+			success(totalRecords, rejects, deadLetters, budget)
 			break
 		}
 		if errRead != nil {
+			pool.Close()
 			failure("Error while reading the inputFile records " + errRead.Error())
 		}
-		index++
+		item, errMap := mapper.Map(record)
+		if errMap != nil {
+			err = rejects.Reject(int64(reader.Line()), errMap.Error(), record)
+			if err != nil {
+				pool.Close()
+				failure("Error while writing reject file " + err.Error())
+			}
+			continue
+		}
+		records = append(records, item)
+		rows = append(rows, record)
 		totalRecords++
 
-		if index == utils.MaxRecordsPerBatch {
-			processRecords(records, tolerated, outputFile)
+		if len(records) == utils.MaxRecordsPerBatch {
+			err = pool.Submit(&dynamowriter.Batch{Items: records, Rows: rows})
+			if err != nil {
+				failure(err.Error())
+			}
 
-			// Trim data
-			records = records[:0]
-			index = 0
+			// The batch is owned by the writers from now on
+			records, rows = nil, nil
 			log.Printf("Total records so far - %v", totalRecords)
-		} else {
-			records = append(records, utils.MarshalRecord(record))
 		}
 	}
 }
 
-/*
-	Process records, append to tmp file and save the records in DynamoDB
-*/
-func processRecords(records []*utils.Record, tolerated bool, tmpFile *os.File) {
-	response, err := utils.BatchWriteItem(records)
-	if err != nil && !tolerated {
-		failure("Error while saving data to dynamodb")
-	}
-	err = utils.AppendFile(response, tmpFile)
-	if err != nil {
-		failure("Error while appending output file")
-	}
-}
-
-func success() {
+func success(totalRecords int, rejects *recordschema.RejectWriter, deadLetters *recordschema.DeadLetterWriter, budget *dynamowriter.ErrorBudget) {
 	// Copy contents from source to destination
 	sourceFile := utils.GetOutputFile(false)
 
-	copyCmd := fmt.Sprintf("aws s3 cp %s s3://%s/%s_Single_Output", sourceFile,
-		os.Getenv(utils.S3BucketName), os.Getenv(utils.S3Key))
-
-	_, err := exec.Command("sh", "-c", copyCmd).Output()
-
+	store, err := objectstore.NewClientFromEnv()
 	if err != nil {
 		failure(err.Error())
 	}
+	err = store.UploadFile(context.Background(), os.Getenv(utils.S3BucketName), os.Getenv(utils.S3Key)+"_Single_Output", sourceFile)
+	if err != nil {
+		failure(err.Error())
+	}
+
+	rejectKey := "none"
+	if rejects.Count() > 0 {
+		err = rejects.Flush()
+		if err != nil {
+			failure("Error while writing reject file " + err.Error())
+		}
+		rejectKey = os.Getenv(utils.S3Key) + "_Single_Rejects"
+		err = store.UploadFile(context.Background(), os.Getenv(utils.S3BucketName), rejectKey, utils.GetRejectFile())
+		if err != nil {
+			failure(err.Error())
+		}
+	}
+
+	deadLetterKey := "none"
+	if deadLetters.Count() > 0 {
+		err = deadLetters.Flush()
+		if err != nil {
+			failure("Error while writing dead letter file " + err.Error())
+		}
+		deadLetterKey = os.Getenv(utils.S3Key) + "_Single_DeadLetters"
+		err = store.UploadFile(context.Background(), os.Getenv(utils.S3BucketName), deadLetterKey, utils.GetDeadLetterFile())
+		if err != nil {
+			failure(err.Error())
+		}
+	}
+	log.Printf("Run summary - %v records read, %v processed, %v rejected (rejects %s), %s (dead letters %s)", totalRecords+rejects.Count(), totalRecords, rejects.Count(), rejectKey, budget, deadLetterKey)
 
 	utils.DeleteOutputFolder()
 	utils.DeleteInputFile()
@@ -115,14 +190,14 @@ func failure(msg string) {
 /*
 	Run pre-requisites before executing the batch
 */
-func initialize() (*os.File, *os.File, error) {
+func initialize(format inputformat.Format) (inputformat.RecordReader, *os.File, error) {
 	// Get input file
 	inputFilePath, err := utils.CopyS3ToEfs()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	inputFile, err := utils.GetFile(*inputFilePath)
+	inputFile, err := utils.OpenInputFile(format, *inputFilePath)
 	if err != nil {
 		log.Printf("Error while getting the input file " + err.Error())
 		return nil, nil, err
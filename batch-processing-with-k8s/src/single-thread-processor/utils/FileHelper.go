@@ -1,12 +1,14 @@
 package utils
 
 import (
+	"context"
 	"encoding/csv"
 	"fmt"
+	"input.format/inputformat"
 	"io"
 	"log"
+	"object.store/objectstore"
 	"os"
-	"os/exec"
 	"strings"
 )
 
@@ -72,7 +74,8 @@ func TruncateFile(filePath string) (*os.File, error) {
 }
 
 /*
-	Read output file and delete the records from DynamoDB based on 'OrderId' (HASH)
+	Read output file and delete the records from DynamoDB based
+	on the hash key of the record schema
 */
 func DeleteProcessedData() {
 	outputFilePath := GetOutputFile(false)
@@ -85,24 +88,22 @@ func DeleteProcessedData() {
 
 		reader := csv.NewReader(outputFile)
 		var orders []string
-		index := 0
 		for {
 			record, errRead := reader.Read()
 			if errRead == io.EOF {
-				DeleteItems(orders)
+				if len(orders) > 0 {
+					DeleteItems(orders)
+				}
 				break
 			}
-			index++
+			orders = append(orders, record[0])
 
 			// Batch to 25 records at a time
-			if index == MaxRecordsPerBatch {
+			if len(orders) == MaxRecordsPerBatch {
 				DeleteItems(orders)
 
 				// Trim data
 				orders = orders[:0]
-				index = 0
-			} else {
-				orders = append(orders, record[0])
 			}
 		}
 	}
@@ -161,6 +162,24 @@ func GetOutputFile(overwrite bool) string {
 	return outputPath
 }
 
+/*
+	Get the file collecting the rejected rows, next to the output file
+*/
+func GetRejectFile() string {
+	dir := getOutputDir()
+	mkDirs(dir)
+	return dir + "/" + GetFileName(InputFilePath) + ".rejects"
+}
+
+/*
+	Get the file collecting the rows failing to be written to DynamoDB, next to the output file
+*/
+func GetDeadLetterFile() string {
+	dir := getOutputDir()
+	mkDirs(dir)
+	return dir + "/" + GetFileName(InputFilePath) + ".deadletters"
+}
+
 /*
 	Equivalent to mkdirs() in unix
 */
@@ -191,24 +210,47 @@ func DeleteInputFile() {
 	}
 }
 
+/*
+	Stream the input object from S3 to EFS
+*/
 func CopyS3ToEfs() (*string, error) {
 	efsDirectory := os.Getenv(EfsDirectoryPath)
-	s3InputFilePath := fmt.Sprintf("s3://%s/%s", os.Getenv(S3BucketName), os.Getenv(S3Key))
 	splitFileDirectory := fmt.Sprintf("%s/%s", efsDirectory, os.Getenv(StatusKey))
 
 	os.RemoveAll(splitFileDirectory)
 	os.MkdirAll(splitFileDirectory, os.ModePerm)
 
+	store, err := objectstore.NewClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
 	// Copy files from S3 to EFS
-	splitCommand := fmt.Sprintf("aws s3 cp %s %s", s3InputFilePath, InputFilePath)
+	err = store.Download(context.Background(), os.Getenv(S3BucketName), os.Getenv(S3Key), InputFilePath)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := exec.Command("sh", "-c", splitCommand).Output()
+	return &InputFilePath, nil
+}
 
+/*
+	Read the metadata of the input object, its content type picks the format of keys
+	without an extension
+*/
+func StatInputFile() (*objectstore.ObjectInfo, error) {
+	store, err := objectstore.NewClientFromEnv()
 	if err != nil {
 		return nil, err
 	}
+	return store.Stat(context.Background(), os.Getenv(S3BucketName), os.Getenv(S3Key))
+}
 
-	return &InputFilePath, nil
+/*
+	Open the records of the input file, JSON objects are read into the columns of the record schema
+*/
+func OpenInputFile(format inputformat.Format, filePath string) (inputformat.RecordReader, error) {
+	return inputformat.OpenFile(format, filePath, recordSchema.ColumnNames())
 }
 
 func getInputFile() string {
@@ -4,5 +4,14 @@ go 1.16
 
 require (
 	github.com/aws/aws-sdk-go v1.38.25
+	input.format/inputformat v0.0.0
 	github.com/redis/go-redis/v9 v9.3.0
+	object.store/objectstore v0.0.0
+	record.schema/recordschema v0.0.0
 )
+
+replace input.format/inputformat => ../inputformat
+
+replace object.store/objectstore => ../objectstore
+
+replace record.schema/recordschema => ../recordschema
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"input.format/inputformat"
+	"io"
 	"log"
+	"object.store/objectstore"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"split.file/main/utils"
-	"strings"
 )
 
 import (
@@ -17,43 +21,191 @@ import (
 */
 func main() {
 	inputKey := os.Getenv(utils.S3Key)
-	if !strings.HasSuffix(inputKey, "csv") {
-		fmt.Println("Only CSV file formats are supported")
+	bucket := os.Getenv(utils.S3BucketName)
+	store, err := objectstore.NewClientFromEnv()
+	if err != nil {
+		failure(err)
+	}
+
+	// Pick the decoder of the input by its extension, or its content type
+	info, err := store.Stat(context.Background(), bucket, inputKey)
+	if err != nil {
+		failure(err)
+	}
+	format, err := inputformat.Detect(inputKey, info.ContentType)
+	if err != nil {
+		fmt.Println(err.Error())
 		return
 	}
 
 	// Delete and recreate table
-	err := utils.RecreateTable()
+	err = utils.RecreateTable()
 	if err != nil {
 		log.Printf("Error while creating dynamodb tables " + err.Error())
 		panic(err)
 	}
 
-	efsDirectory := os.Getenv(utils.EfsDirectoryPath)
-	s3InputFilePath := fmt.Sprintf("s3://%s/%s", os.Getenv(utils.S3BucketName), os.Getenv(utils.S3Key))
-	splitFileDirectory := fmt.Sprintf("%s/%s", efsDirectory, os.Getenv(utils.StatusKey))
+	splitMode, err := utils.GetSplitMode()
+	if err != nil {
+		failure(err)
+	}
+	if splitMode == utils.SplitModeRange && !format.IsPlainCsv() {
+		failure(fmt.Errorf("%s split mode needs an uncompressed CSV input, s3://%s/%s is %s", utils.SplitModeRange, bucket, inputKey, format))
+	}
+	maxLines, err := utils.GetMaxLinesPerBatch()
+	if err != nil {
+		failure(err)
+	}
 
 	// Cleanup
 	utils.RemoveSet()
+
+	var manifest *utils.Manifest
+	if splitMode == utils.SplitModeRange {
+		manifest = splitRanges(store, maxLines, bucket, inputKey)
+	} else {
+		manifest = splitFiles(store, format, maxLines, bucket, inputKey)
+	}
+
+	if len(manifest.Chunks) > 0 {
+		err = utils.CheckHeader(manifest.Header)
+		if err != nil {
+			failure(err)
+		}
+	}
+
+	// Update REDIS cache with the split files or byte ranges
+	workItems := manifest.ChunkPaths()
+	if len(workItems) > 0 {
+		utils.AddItemsToSet(workItems)
+	}
+
+	fmt.Printf("Split stage complete and items in REDIS cache %s", utils.GetDataFromSet())
+}
+
+/*
+	Split the file into smaller CSV files on EFS, each processed from there
+*/
+func splitFiles(store *objectstore.Client, format inputformat.Format, maxLines int, bucket string, inputKey string) *utils.Manifest {
+	efsDirectory := os.Getenv(utils.EfsDirectoryPath)
+	splitFileDirectory := fmt.Sprintf("%s/%s", efsDirectory, os.Getenv(utils.StatusKey))
 	os.RemoveAll(splitFileDirectory)
 	os.MkdirAll(splitFileDirectory, os.ModePerm)
 
-	// Split large file into smaller files to EFS
-	splitCommand := fmt.Sprintf("aws s3 cp %s - | split -l %s - %s/%s.",
-		s3InputFilePath, utils.GetMaxLinesPerBatch(), splitFileDirectory, utils.GetFileName(s3InputFilePath))
+	reader := openInput(store, format, splitFileDirectory, bucket, inputKey)
+	defer reader.Close()
 
-	fmt.Println(splitCommand)
-	_, err = exec.Command("sh", "-c", splitCommand).Output()
+	splitPrefix := fmt.Sprintf("%s/%s.", splitFileDirectory, utils.GetFileName(inputKey))
+	fmt.Printf("Splitting %s input s3://%s/%s into %s* with %d records per file\n", format, bucket, inputKey, splitPrefix, maxLines)
 
+	manifest, err := utils.SplitCSV(reader, maxLines, splitPrefix)
 	if err != nil {
 		failure(err)
 	}
+	manifest.Source = fmt.Sprintf("s3://%s/%s", bucket, inputKey)
+	err = utils.WriteManifest(manifest, splitFileDirectory)
+	if err != nil {
+		failure(err)
+	}
+	fmt.Printf("Split %d records into %d files, manifest %s/%s\n", manifest.Records, len(manifest.Chunks), splitFileDirectory, utils.ManifestFileName)
+	return manifest
+}
 
-	// Update REDIS cache with the split file information
-	splitFiles := utils.GetFileList(splitFileDirectory)
-	utils.AddItemsToSet(splitFiles)
+/*
+	Stream the large file from S3 through the decoder of its format. Parquet needs random
+	access, so it is downloaded next to the split files first.
+*/
+func openInput(store *objectstore.Client, format inputformat.Format, splitFileDirectory string, bucket string, inputKey string) inputformat.RecordReader {
+	if format.Encoding == inputformat.Parquet {
+		inputPath := filepath.Join(splitFileDirectory, "input", utils.GetFileName(inputKey))
+		err := store.Download(context.Background(), bucket, inputKey, inputPath)
+		if err != nil {
+			failure(err)
+		}
+		reader, err := inputformat.OpenFile(format, inputPath, utils.RecordColumns())
+		if err != nil {
+			failure(err)
+		}
+		return &removingReader{RecordReader: reader, dir: filepath.Dir(inputPath)}
+	}
 
-	fmt.Printf("Split stage complete and items in REDIS cache %s", utils.GetDataFromSet())
+	inputFile, err := store.Open(context.Background(), bucket, inputKey)
+	if err != nil {
+		failure(err)
+	}
+	reader, err := inputformat.NewReader(format, inputFile, utils.RecordColumns())
+	if err != nil {
+		inputFile.Close()
+		failure(err)
+	}
+	return &closingReader{RecordReader: reader, input: inputFile}
+}
+
+/*
+	Record reader closing the S3 stream it decodes
+*/
+type closingReader struct {
+	inputformat.RecordReader
+	input io.Closer
+}
+
+func (r *closingReader) Close() error {
+	r.RecordReader.Close()
+	return r.input.Close()
+}
+
+/*
+	Record reader deleting the downloaded input once closed
+*/
+type removingReader struct {
+	inputformat.RecordReader
+	dir string
+}
+
+func (r *removingReader) Close() error {
+	err := r.RecordReader.Close()
+	os.RemoveAll(r.dir)
+	return err
+}
+
+/*
+	Compute record aligned byte ranges of the S3 object, each streamed by a processor with
+	ranged GETs, so that nothing is copied to EFS. The manifest is uploaded next to the input.
+*/
+func splitRanges(store *objectstore.Client, maxLines int, bucket string, inputKey string) *utils.Manifest {
+	fmt.Printf("Computing byte ranges of s3://%s/%s with %d records per range\n", bucket, inputKey, maxLines)
+
+	// Cleanup output parts of an earlier run, merged by the last processor
+	staleParts, err := store.ListKeys(context.Background(), bucket, inputKey+"_Output.parts/")
+	if err != nil {
+		failure(err)
+	}
+	err = store.DeleteKeys(context.Background(), bucket, staleParts)
+	if err != nil {
+		failure(err)
+	}
+
+	inputFile, err := store.Open(context.Background(), bucket, inputKey)
+	if err != nil {
+		failure(err)
+	}
+	defer inputFile.Close()
+
+	manifest, err := utils.SplitRanges(inputFile, maxLines, bucket, inputKey)
+	if err != nil {
+		failure(err)
+	}
+	data, err := manifest.JSON()
+	if err != nil {
+		failure(err)
+	}
+	manifestKey := inputKey + "_" + utils.ManifestFileName
+	err = store.Upload(context.Background(), bucket, manifestKey, bytes.NewReader(data))
+	if err != nil {
+		failure(err)
+	}
+	fmt.Printf("Split %d records into %d ranges, manifest s3://%s/%s\n", manifest.Records, len(manifest.Chunks), bucket, manifestKey)
+	return manifest
 }
 
 /*
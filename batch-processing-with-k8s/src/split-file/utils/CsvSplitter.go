@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"input.format/inputformat"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const ManifestFileName = "manifest.json"
+
+/*
+	Split file written by SplitCSV, or byte range computed by SplitRanges
+*/
+type Chunk struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Start   int64  `json:"start,omitempty"` // byte range of the input, for ranges computed by SplitRanges
+	End     int64  `json:"end,omitempty"`
+	Bytes   int64  `json:"bytes"`
+	Records int    `json:"records"` // records without the header row
+	SHA256  string `json:"sha256"`
+}
+
+/*
+	Description of a split input, written next to the chunks
+*/
+type Manifest struct {
+	Source  string   `json:"source"`
+	Header  []string `json:"header"`
+	Records int      `json:"records"`
+	Chunks  []Chunk  `json:"chunks"`
+}
+
+/*
+	Splits the records of an input into CSV chunks of at most maxRecords records, named
+	prefix followed by aa, ab, ... as split(1) names them. CSV inputs are read with a CSV
+	reader, so quoted fields spanning several lines stay whole, and the header row is
+	written at the top of every chunk.
+*/
+func SplitCSV(reader inputformat.RecordReader, maxRecords int, prefix string) (*Manifest, error) {
+	manifest := &Manifest{}
+	header := reader.Header()
+	if header == nil {
+		return manifest, nil
+	}
+	manifest.Header = header
+
+	var chunk *chunkWriter
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if chunk != nil {
+				chunk.file.Close()
+			}
+			return nil, err
+		}
+
+		if chunk == nil {
+			chunk, err = newChunkWriter(prefix+splitSuffix(len(manifest.Chunks)), header)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := chunk.writer.Write(record); err != nil {
+			chunk.file.Close()
+			return nil, err
+		}
+		chunk.records++
+		manifest.Records++
+
+		if chunk.records == maxRecords {
+			if err := chunk.close(manifest); err != nil {
+				return nil, err
+			}
+			chunk = nil
+		}
+	}
+
+	if chunk != nil {
+		if err := chunk.close(manifest); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+/*
+	Writes the manifest as JSON into the given directory
+*/
+func WriteManifest(manifest *Manifest, dir string) error {
+	data, err := manifest.JSON()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ManifestFileName), data, 0644)
+}
+
+/*
+	Manifest as indented JSON
+*/
+func (m *Manifest) JSON() ([]byte, error) {
+	return json.MarshalIndent(m, "", "  ")
+}
+
+/*
+	Paths of the chunks listed in a manifest, the work items of the file processors
+*/
+func (m *Manifest) ChunkPaths() []string {
+	paths := make([]string, 0, len(m.Chunks))
+	for _, chunk := range m.Chunks {
+		paths = append(paths, chunk.Path)
+	}
+	return paths
+}
+
+type chunkWriter struct {
+	path    string
+	file    *os.File
+	writer  *csv.Writer
+	counter *byteCounter
+	hash    hash.Hash
+	records int
+}
+
+func newChunkWriter(path string, header []string) (*chunkWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk := &chunkWriter{path: path, file: file, counter: &byteCounter{}, hash: sha256.New()}
+	chunk.writer = csv.NewWriter(io.MultiWriter(file, chunk.counter, chunk.hash))
+	if err := chunk.writer.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return chunk, nil
+}
+
+func (c *chunkWriter) close(manifest *Manifest) error {
+	c.writer.Flush()
+	if err := c.writer.Error(); err != nil {
+		c.file.Close()
+		return err
+	}
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+
+	manifest.Chunks = append(manifest.Chunks, Chunk{
+		Name:    filepath.Base(c.path),
+		Path:    c.path,
+		Bytes:   c.counter.bytes,
+		Records: c.records,
+		SHA256:  hex.EncodeToString(c.hash.Sum(nil)),
+	})
+	return nil
+}
+
+type byteCounter struct {
+	bytes int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.bytes += int64(len(p))
+	return len(p), nil
+}
+
+/*
+	Suffix of the n-th split file: two letters, growing by a letter every time
+	the suffixes of the current length are exhausted
+*/
+func splitSuffix(n int) string {
+	length, count := 2, 26*26
+	for n >= count {
+		n -= count
+		length++
+		count *= 26
+	}
+
+	suffix := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		suffix[i] = byte('a' + n%26)
+		n /= 26
+	}
+	return string(suffix)
+}
@@ -8,13 +8,12 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"log"
 	"os"
+	"record.schema/recordschema"
 	"time"
 )
 
 const (
 	RetryCounter = 10
-	tableName    = "Order"
-	hashKey      = "OrderId"
 )
 
 // Creates dynamodb session
@@ -23,8 +22,29 @@ var (
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 	svc = dynamodb.New(sess)
+
+	// Columns of the input files and the items they map to, see RECORD_SCHEMA
+	recordSchema = recordschema.MustLoadFromEnv()
+	tableName    = recordSchema.Table
+	hashKey      = recordSchema.HashKey()
 )
 
+/*
+	Columns of the record schema, the fields read from JSON inputs
+*/
+func RecordColumns() []string {
+	return recordSchema.ColumnNames()
+}
+
+/*
+	Check that a header row has the columns required by the record schema, so that a
+	file the processors cannot map fails before it is fanned out
+*/
+func CheckHeader(header []string) error {
+	_, err := recordSchema.NewMapper(header)
+	return err
+}
+
 /*
 	Recreates table and waits for its completion
 */
@@ -1,8 +1,9 @@
 package utils
 
 import (
+	"fmt"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -15,39 +16,43 @@ const (
 	RedisCacheEndpoint = "REDIS_CACHE_ENDPOINT"
 	RedisCachePort     = "REDIS_CACHE_PORT"
 	ReBuildTable       = "REBUILD_TABLE"
+	SplitMode          = "SPLIT_MODE"
+
+	// Split files written to EFS, or byte ranges of the S3 object read by the processors
+	SplitModeEfs   = "efs"
+	SplitModeRange = "range"
 
 	defaultMaxLines = "10000"
 )
 
 /*
-	Get list of all the files in a directory
+	Get maximum allowed per split file
 */
-func GetFileList(dir string) []string {
-	var files []string
-
-	// Walk and collect all the file paths
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if strings.Contains(path, ".csv") {
-			files = append(files, path)
-		}
-		return nil
-	})
-	if err != nil {
-		panic(err)
+func GetMaxLinesPerBatch() (int, error) {
+	maxLines := os.Getenv(MaxLinesPerBatch)
+	if len(strings.TrimSpace(maxLines)) == 0 {
+		maxLines = defaultMaxLines
 	}
-	return files
+
+	lines, err := strconv.Atoi(strings.TrimSpace(maxLines))
+	if err != nil || lines < 1 {
+		return 0, fmt.Errorf("invalid %s %q", MaxLinesPerBatch, maxLines)
+	}
+	return lines, nil
 }
 
 /*
-	Get maximum allowed per split file
+	Get the split mode, efs unless set
 */
-func GetMaxLinesPerBatch() string {
-	maxLines := os.Getenv(MaxLinesPerBatch)
-	if len(strings.TrimSpace(maxLines)) > 0 {
-		return maxLines
-	} else {
-		return defaultMaxLines
+func GetSplitMode() (string, error) {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv(SplitMode)))
+	switch mode {
+	case "":
+		return SplitModeEfs, nil
+	case SplitModeEfs, SplitModeRange:
+		return mode, nil
 	}
+	return "", fmt.Errorf("invalid %s %q", SplitMode, mode)
 }
 
 /*
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+/*
+	Work item of a byte range of an S3 object, as read by the file processors
+*/
+func FormatRange(bucket string, key string, start int64, end int64) string {
+	return fmt.Sprintf("s3://%s/%s#bytes=%d-%d", bucket, key, start, end)
+}
+
+/*
+	Computes byte ranges of at most maxRecords records of a CSV stream without writing them
+	anywhere. Ranges start and end on record boundaries, a line break inside a quoted field
+	does not end a record, and the header row is left out of every range.
+*/
+func SplitRanges(input io.Reader, maxRecords int, bucket string, key string) (*Manifest, error) {
+	reader := bufio.NewReaderSize(input, 1024*1024)
+	manifest := &Manifest{Source: fmt.Sprintf("s3://%s/%s", bucket, key)}
+
+	var (
+		offset     int64
+		inQuotes   bool
+		nonEmpty   bool // the current line has more than a carriage return
+		inHeader   = true
+		header     bytes.Buffer
+		rangeStart int64
+		records    int
+		checksum   hash.Hash = sha256.New()
+	)
+
+	closeRange := func() {
+		if records == 0 {
+			return
+		}
+		manifest.Chunks = append(manifest.Chunks, Chunk{
+			Name:    fmt.Sprintf("%s#bytes=%d-%d", GetFileName(key), rangeStart, offset),
+			Path:    FormatRange(bucket, key, rangeStart, offset),
+			Start:   rangeStart,
+			End:     offset,
+			Bytes:   offset - rangeStart,
+			Records: records,
+			SHA256:  hex.EncodeToString(checksum.Sum(nil)),
+		})
+		rangeStart = offset
+		records = 0
+		checksum.Reset()
+	}
+
+	// A record ends on a line break outside quotes. Doubled quotes inside a quoted
+	// field toggle the state twice, so counting quotes is enough.
+	endRecord := func() error {
+		if !nonEmpty {
+			// csv readers skip blank lines, so they are not records
+			return nil
+		}
+		nonEmpty = false
+		if inHeader {
+			inHeader = false
+			rangeStart = offset
+			checksum.Reset()
+			fields, err := csv.NewReader(bytes.NewReader(header.Bytes())).Read()
+			if err != nil {
+				return fmt.Errorf("invalid header: %v", err)
+			}
+			manifest.Header = fields
+			return nil
+		}
+		records++
+		manifest.Records++
+		if records == maxRecords {
+			closeRange()
+		}
+		return nil
+	}
+
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset++
+		if inHeader {
+			header.WriteByte(b)
+		} else {
+			checksum.Write([]byte{b})
+		}
+
+		switch {
+		case b == '"':
+			inQuotes = !inQuotes
+			nonEmpty = true
+		case b == '\n' && !inQuotes:
+			if err := endRecord(); err != nil {
+				return nil, err
+			}
+			if records == 0 {
+				// blank lines between ranges belong to neither
+				rangeStart = offset
+				checksum.Reset()
+			}
+		case b != '\r':
+			nonEmpty = true
+		}
+	}
+
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quoted field at byte %d", offset)
+	}
+	// Last record without a trailing line break
+	if err := endRecord(); err != nil {
+		return nil, err
+	}
+	closeRange()
+	return manifest, nil
+}
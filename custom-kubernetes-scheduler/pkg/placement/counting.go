@@ -0,0 +1,73 @@
+package placement
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"time"
+)
+
+// Pod counting modes accepted by the custom-pod-schedule-counting-mode annotation
+const (
+	CountingModeAll       = "all"       // every pod that is not terminating (default)
+	CountingModeScheduled = "scheduled" // pods bound to a node and not in a terminal phase
+	CountingModeReady     = "ready"     // pods whose Ready condition is true
+)
+
+// Pods admitted this recently are still on their way to be scheduled and ready. The scheduled
+// and ready modes count them too, so that the admissions of a scale-up see each other.
+const InFlightGracePeriod = 5 * time.Minute
+
+// Counts the pods that satisfy a node label under the given counting mode
+func CountPods(pods []corev1.Pod, countingMode string) int {
+	now := time.Now()
+	count := 0
+	for i := range pods {
+		switch countingMode {
+		case CountingModeScheduled:
+			if IsPodScheduled(&pods[i]) || IsPodInFlight(&pods[i], now) {
+				count++
+			}
+		case CountingModeReady:
+			if IsPodReady(&pods[i]) || IsPodInFlight(&pods[i], now) {
+				count++
+			}
+		default:
+			count++
+		}
+	}
+	return count
+}
+
+func IsPodScheduled(pod *corev1.Pod) bool {
+	return pod.Spec.NodeName != "" && pod.Status.Phase != corev1.PodFailed && pod.Status.Phase != corev1.PodSucceeded
+}
+
+func IsPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// A pod admitted within the grace period that is neither in a terminal phase, nor found
+// unschedulable, nor crash-looping. Pods not created yet have no creation time.
+func IsPodInFlight(pod *corev1.Pod, now time.Time) bool {
+	if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
+		return false
+	}
+	if !pod.CreationTimestamp.IsZero() && now.Sub(pod.CreationTimestamp.Time) > InFlightGracePeriod {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse && condition.Reason == corev1.PodReasonUnschedulable {
+			return false
+		}
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting != nil && status.State.Waiting.Reason == "CrashLoopBackOff" {
+			return false
+		}
+	}
+	return true
+}
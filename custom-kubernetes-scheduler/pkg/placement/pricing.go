@@ -0,0 +1,172 @@
+package placement
+
+import (
+	"fmt"
+	"github.com/ghodss/yaml"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Weight value asking for a target's weight to be derived from the price table
+const AutoWeight = "auto"
+
+// Key of the price table in a PRICE_TABLE ConfigMap
+const PriceTableConfigMapKey = "prices.yaml"
+
+// Scale of derived weights, so that cheap and expensive targets still get distinct integers
+const costWeightScale = 1000
+
+// Hourly prices used to derive cost-weighted strategies, e.g.
+//
+//	defaultRisk: 0
+//	targets:
+//	  capacity-type=spot: {price: 0.012, risk: 0.2}
+//	  capacity-type=on-demand: {price: 0.024}
+//	instanceTypes:
+//	  m5.large: {price: 0.096, replicasPerInstance: 4, risk: 0}
+//
+// Target prices are per replica-hour and keyed by node label (target kinds allowed).
+// Instance type prices are per instance-hour and divided by replicasPerInstance (default 1).
+// The risk, between 0 and 1, is the expected share of capacity lost to interruptions.
+type PriceTable struct {
+	DefaultRisk   float64                  `json:"defaultRisk"`
+	Targets       map[string]TargetPrice   `json:"targets"`
+	InstanceTypes map[string]InstancePrice `json:"instanceTypes"`
+}
+
+type TargetPrice struct {
+	Price float64  `json:"price"`
+	Risk  *float64 `json:"risk,omitempty"`
+}
+
+type InstancePrice struct {
+	Price               float64  `json:"price"`
+	ReplicasPerInstance int      `json:"replicasPerInstance,omitempty"`
+	Risk                *float64 `json:"risk,omitempty"`
+}
+
+// Looks up the price per replica-hour and the risk of a node label, or reports false
+type PriceFunc func(nodeLabel string) (price float64, risk float64, ok bool)
+
+// Parses a YAML or JSON price table, expanding target kinds in its node labels
+func ParsePriceTable(data []byte) (*PriceTable, error) {
+	table := &PriceTable{}
+	if err := yaml.Unmarshal(data, table); err != nil {
+		return nil, err
+	}
+
+	targets := make(map[string]TargetPrice, len(table.Targets))
+	for nodeLabel, price := range table.Targets {
+		if price.Price <= 0 {
+			return nil, fmt.Errorf("price of %s must be positive", nodeLabel)
+		}
+		targets[ExpandNodeLabel(strings.TrimSpace(nodeLabel))] = price
+	}
+	table.Targets = targets
+
+	for instanceType, price := range table.InstanceTypes {
+		if price.Price <= 0 {
+			return nil, fmt.Errorf("price of instance type %s must be positive", instanceType)
+		}
+	}
+	return table, nil
+}
+
+// Returns the price and risk listed for a node label
+func (t *PriceTable) TargetPrice(nodeLabel string) (float64, float64, bool) {
+	price, ok := t.Targets[nodeLabel]
+	if !ok {
+		return 0, 0, false
+	}
+	return price.Price, t.risk(price.Risk), true
+}
+
+// Returns the price per replica-hour and the risk of an instance type
+func (t *PriceTable) InstanceTypePrice(instanceType string) (float64, float64, bool) {
+	price, ok := t.InstanceTypes[instanceType]
+	if !ok {
+		return 0, 0, false
+	}
+	replicas := price.ReplicasPerInstance
+	if replicas <= 0 {
+		replicas = 1
+	}
+	return price.Price / float64(replicas), t.risk(price.Risk), true
+}
+
+func (t *PriceTable) risk(risk *float64) float64 {
+	if risk == nil {
+		return t.DefaultRisk
+	}
+	return *risk
+}
+
+// Reports whether a strategy asks for weights derived from prices
+func UsesCostWeights(strategy string) bool {
+	return strings.Contains(strategy, "weight="+AutoWeight)
+}
+
+// Replaces every weight=auto of a strategy, at any nesting level, with a weight in
+// proportion to the capacity a unit of cost buys on that target, (1 - risk) / price.
+func CostWeightedStrategy(strategy string, priceOf PriceFunc) (string, error) {
+	targets, subStrategies, err := splitTargets(strategy)
+	if err != nil {
+		return "", err
+	}
+
+	for i, target := range targets {
+		parts := strings.Split(target, ",")
+		nodeLabel := ""
+		for _, part := range parts {
+			if key, _, _ := strings.Cut(part, "="); key != "base" && key != "weight" {
+				nodeLabel = ExpandNodeLabel(part)
+			}
+		}
+
+		for j, part := range parts {
+			if part != "weight="+AutoWeight {
+				continue
+			}
+			price, risk, ok := priceOf(nodeLabel)
+			if !ok {
+				return "", fmt.Errorf("no price for %s", nodeLabel)
+			}
+			weight := int(math.Round(costWeightScale * math.Max(1-risk, 0) / price))
+			parts[j] = "weight=" + strconv.Itoa(max(weight, 1))
+		}
+		targets[i] = strings.Join(parts, ",")
+
+		if subStrategies[i] != "" {
+			subStrategy, err := CostWeightedStrategy(subStrategies[i], priceOf)
+			if err != nil {
+				return "", err
+			}
+			targets[i] += "[" + subStrategy + "]"
+		}
+	}
+	return strings.Join(targets, ":"), nil
+}
+
+// Returns the hourly cost of running the distributed replicas. A leaf is priced by its full
+// node label, otherwise by its most specific dimension that has a price. Reports false when
+// some leaf with replicas has no price.
+func ExpectedHourlyCost(nodeLabelStrategyList []NodeLabelStrategy, priceOf PriceFunc) (float64, bool) {
+	cost := 0.0
+	for _, nodeLabelStrategy := range nodeLabelStrategyList {
+		if nodeLabelStrategy.Replicas == 0 {
+			continue
+		}
+
+		price, _, ok := priceOf(nodeLabelStrategy.NodeLabel)
+		dimensions := strings.Split(nodeLabelStrategy.NodeLabel, ",")
+		for i := len(dimensions) - 1; !ok && i >= 0 && len(dimensions) > 1; i-- {
+			price, _, ok = priceOf(dimensions[i])
+		}
+		if !ok {
+			return 0, false
+		}
+		cost += price * float64(nodeLabelStrategy.Replicas)
+	}
+	return cost, true
+}
@@ -0,0 +1,329 @@
+package placement
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Annotations declaring a custom scheduling strategy, on an owner or its namespace
+const (
+	StrategyKey         = "custom-pod-schedule-strategy"
+	StrategyTemplateKey = "custom-pod-schedule-strategy-template"
+	CountingModeKey     = "custom-pod-schedule-counting-mode"
+	GroupKey            = "custom-pod-schedule-group"
+	ShadowKey           = "custom-pod-schedule-shadow"
+)
+
+// Scheduler profile of the secondary scheduler running the strategy plugin. The webhook
+// leaves pods with this spec.schedulerName alone.
+const SchedulerName = "custom-kube-scheduler"
+
+// Well-known node labels that strategies may name by target kind instead of the full key,
+// e.g. "capacity-type=spot" for "karpenter.sh/capacity-type=spot"
+const (
+	TargetKindCapacityType = "capacity-type"
+	TargetKindNodePool     = "nodepool"
+	TargetKindZone         = "zone"
+
+	CapacityTypeLabel = "karpenter.sh/capacity-type"
+	NodePoolLabel     = "karpenter.sh/nodepool"
+	ZoneLabel         = "topology.kubernetes.io/zone"
+)
+
+var targetKinds = map[string]string{
+	TargetKindCapacityType: CapacityTypeLabel,
+	TargetKindNodePool:     NodePoolLabel,
+	TargetKindZone:         ZoneLabel,
+}
+
+// Replicas wanted on one node label of a strategy. For nested strategies the node label of
+// a leaf combines the node labels of every level, e.g. "karpenter.sh/capacity-type=spot,
+// topology.kubernetes.io/zone=us-west-2a", and all of them must match.
+type NodeLabelStrategy struct {
+	NodeLabel string
+	Replicas  int
+	Weight    int
+}
+
+// Parses a strategy of the form
+//
+//	key=value,base=N,weight=W:key=value,weight=W:...
+//
+// and distributes numOfReplicas over its node labels: the node label carrying a base gets
+// that many replicas first, the rest is shared out in proportion to the weights, with the
+// last node label taking the rounding remainder. Any target may be followed by a nested
+// strategy in brackets, which distributes that target's replicas over a further dimension:
+//
+//	capacity-type=spot,weight=70[zone=a,weight=1:zone=b,weight=1]:capacity-type=on-demand,weight=30[...]
+//
+// Nested targets are returned as their leaves only. The list is returned even when the
+// strategy is invalid, together with the error.
+func Distribute(log *slog.Logger, Strategy string, numOfReplicas int) ([]NodeLabelStrategy, error) {
+
+	nodeLabelStrategyList := []NodeLabelStrategy{}
+
+	var result error
+
+	log.Info("parsing strategy", "strategy", Strategy, "replicas", numOfReplicas)
+
+	totalWeight := 0
+	replicaCount := 0
+
+	StrategyList, subStrategyList, err := splitTargets(Strategy)
+	if err != nil {
+		log.Error("invalid nesting in strategy", "strategy", Strategy, "error", err)
+		return nodeLabelStrategyList, err
+	}
+
+	numOfBaseValues := 0
+
+	baseNodeLabel := ""
+
+	baseNodeLabelIndex := 0
+
+	for i, nodeStrategy := range StrategyList {
+
+		nodeStrategyPartsList := strings.Split(nodeStrategy, ",")
+
+		log.Debug("node strategy", "nodeStrategy", nodeStrategy, "parts", nodeStrategyPartsList)
+
+		base := 0
+		weight := 0
+		nodeLabel := ""
+		var err error
+
+		for _, nodeStrategyPart := range nodeStrategyPartsList {
+
+			nodeStrategySubPartList := strings.Split(nodeStrategyPart, "=")
+			log.Debug("node strategy part", "nodeStrategyPart", nodeStrategyPart, "subParts", nodeStrategySubPartList)
+
+			if len(nodeStrategySubPartList) != 2 {
+				log.Error("invalid key=value part in strategy", "strategy", Strategy, "part", nodeStrategyPart)
+				return nodeLabelStrategyList, fmt.Errorf("invalid part %q in strategy %q, expected key=value", nodeStrategyPart, Strategy)
+			}
+
+			if nodeStrategySubPartList[0] == "base" {
+
+				if numOfBaseValues != 0 {
+					log.Warn("base value cannot be non-zero for more than one node strategy", "strategy", Strategy)
+					result = fmt.Errorf("more than one base in strategy %q", Strategy)
+
+				} else {
+					numOfBaseValues += 1
+				}
+
+				base, err = strconv.Atoi(nodeStrategySubPartList[1])
+				if err != nil {
+					log.Error("invalid base value in strategy", "strategy", Strategy, "error", err)
+					return nodeLabelStrategyList, fmt.Errorf("invalid base value in strategy %q: %v", Strategy, err)
+				}
+
+				if base > numOfReplicas {
+					base = numOfReplicas
+				}
+
+				numOfReplicas = numOfReplicas - base
+
+				log.Debug("base value", "base", base)
+
+			} else if nodeStrategySubPartList[0] == "weight" {
+
+				weight, err = strconv.Atoi(nodeStrategySubPartList[1])
+				if err != nil {
+					log.Error("invalid weight value in strategy", "strategy", Strategy, "error", err)
+					return nodeLabelStrategyList, fmt.Errorf("invalid weight value in strategy %q: %v", Strategy, err)
+				}
+				totalWeight += weight
+
+				log.Debug("weight value", "weight", weight)
+
+			} else {
+				nodeLabel = ExpandNodeLabel(nodeStrategyPart)
+				log.Debug("node label", "key", nodeStrategySubPartList[0], "value", nodeStrategySubPartList[1])
+			}
+		}
+
+		if numOfBaseValues == 1 {
+			if baseNodeLabel == "" {
+				baseNodeLabel = nodeLabel
+				baseNodeLabelIndex = i
+			}
+		}
+
+		nodeLabelStrategyList = append(nodeLabelStrategyList, NodeLabelStrategy{
+			NodeLabel: nodeLabel,
+			Replicas:  base,
+			Weight:    weight,
+		})
+
+	}
+
+	if numOfReplicas > 0 && totalWeight == 0 {
+		return nodeLabelStrategyList, fmt.Errorf("strategy %q has replicas to distribute but no weights", Strategy)
+	}
+
+	if numOfReplicas > 0 {
+
+		weight := nodeLabelStrategyList[baseNodeLabelIndex].Weight
+		baseReplicas := nodeLabelStrategyList[baseNodeLabelIndex].Replicas
+		weightReplicas := int(numOfReplicas * weight / totalWeight)
+		baseReplicas = baseReplicas + weightReplicas
+		replicaCount = weightReplicas
+
+		nodeLabelStrategyList[baseNodeLabelIndex].Replicas = baseReplicas
+
+		totalNumOfLables := len(nodeLabelStrategyList)
+		log.Debug("base node label", "baseNodeLabel", baseNodeLabel, "baseReplicas", baseReplicas, "replicaCount", replicaCount, "numOfReplicas", numOfReplicas, "totalNumOfLabels", totalNumOfLables)
+
+		labelNum := 0
+
+		for index, nodeLabelStrategy := range nodeLabelStrategyList {
+
+			if index != baseNodeLabelIndex {
+
+				log.Debug("distributing weighted replicas", "labelNum", labelNum, "nodeLabelStrategy", nodeLabelStrategy, "totalWeight", totalWeight, "replicaCount", replicaCount, "numOfReplicas", numOfReplicas)
+				if labelNum == totalNumOfLables-2 {
+					weightReplicas = numOfReplicas - replicaCount
+				} else {
+
+					weightReplicas = int(numOfReplicas * nodeLabelStrategy.Weight / totalWeight)
+				}
+
+				nodeLabelStrategy.Replicas += weightReplicas
+				replicaCount = replicaCount + weightReplicas
+
+				nodeLabelStrategyList[index] = nodeLabelStrategy
+
+				log.Debug("distributed weighted replicas", "labelNum", labelNum, "weightReplicas", weightReplicas, "nodeLabelStrategy", nodeLabelStrategy, "replicaCount", replicaCount, "numOfReplicas", numOfReplicas)
+
+				labelNum += 1
+			}
+
+		}
+
+	}
+
+	log.Debug("parsed strategy", "nodeLabelStrategyList", nodeLabelStrategyList, "numOfBaseValues", numOfBaseValues, "totalWeight", totalWeight, "numOfReplicas", numOfReplicas, "replicaCount", replicaCount)
+
+	if !IsNested(Strategy) {
+		return nodeLabelStrategyList, result
+	}
+
+	leaves := []NodeLabelStrategy{}
+	for i, nodeLabelStrategy := range nodeLabelStrategyList {
+		if subStrategyList[i] == "" {
+			leaves = append(leaves, nodeLabelStrategy)
+			continue
+		}
+
+		subList, err := Distribute(log, subStrategyList[i], nodeLabelStrategy.Replicas)
+		if err != nil {
+			return leaves, err
+		}
+		for _, sub := range subList {
+			sub.NodeLabel = nodeLabelStrategy.NodeLabel + "," + sub.NodeLabel
+			leaves = append(leaves, sub)
+		}
+	}
+
+	log.Debug("expanded nested strategy", "leaves", leaves)
+	return leaves, result
+}
+
+// Reports whether a strategy has nested sub-strategies
+func IsNested(strategy string) bool {
+	return strings.Contains(strategy, "[")
+}
+
+// Splits a strategy into its top-level targets, separating each target from the nested
+// strategy in brackets that may follow it
+func splitTargets(strategy string) ([]string, []string, error) {
+	targets := []string{}
+	subStrategies := []string{}
+
+	depth := 0
+	start := 0
+	for i := 0; i <= len(strategy); i++ {
+		if i < len(strategy) {
+			switch strategy[i] {
+			case '[':
+				depth++
+				continue
+			case ']':
+				depth--
+				if depth < 0 {
+					return nil, nil, fmt.Errorf("unbalanced ] in strategy %q", strategy)
+				}
+				continue
+			case ':':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		if depth != 0 {
+			return nil, nil, fmt.Errorf("unbalanced [ in strategy %q", strategy)
+		}
+
+		target := strategy[start:i]
+		subStrategy := ""
+		if open := strings.Index(target, "["); open >= 0 {
+			if !strings.HasSuffix(target, "]") {
+				return nil, nil, fmt.Errorf("nested strategy must end its target in strategy %q", strategy)
+			}
+			target, subStrategy = target[:open], target[open+1:len(target)-1]
+		}
+		targets = append(targets, target)
+		subStrategies = append(subStrategies, subStrategy)
+		start = i + 1
+	}
+	return targets, subStrategies, nil
+}
+
+// Reports whether a set of labels (node labels or a pod's node selector) carries every
+// key=value pair of the node label of a strategy
+func MatchesNodeLabel(labels map[string]string, nodeLabel string) bool {
+	selector := NodeSelectorOf(nodeLabel)
+	if len(selector) == 0 {
+		return false
+	}
+	for key, value := range selector {
+		if labelValue, found := labels[key]; !found || labelValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the node selector for the node label of a strategy, one entry per dimension
+func NodeSelectorOf(nodeLabel string) map[string]string {
+	selector := map[string]string{}
+	for _, pair := range strings.Split(nodeLabel, ",") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			selector[key] = value
+		}
+	}
+	return selector
+}
+
+// Expands a target written with a target kind into its full node label, leaving raw
+// key=value node labels unchanged
+func ExpandNodeLabel(target string) string {
+	kind, value, ok := strings.Cut(target, "=")
+	if !ok {
+		return target
+	}
+	if key, found := targetKinds[strings.TrimSpace(kind)]; found {
+		return key + "=" + value
+	}
+	return target
+}
+
+// Returns the Karpenter NodePool a node label targets, or an empty string
+func NodePoolOf(nodeLabel string) string {
+	return NodeSelectorOf(nodeLabel)[NodePoolLabel]
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"k8s.io/component-base/cli"
+	"k8s.io/kubernetes/cmd/kube-scheduler/app"
+	"os"
+)
+
+// Secondary scheduler: the upstream kube-scheduler with the CustomPodScheduleStrategy plugin
+// registered. Pods opt in through spec.schedulerName, see
+// deploy/custom-kube-scheduler-plugin-template.yaml for the profile enabling the plugin.
+func main() {
+	command := app.NewSchedulerCommand(
+		app.WithPlugin(Name, New),
+	)
+
+	os.Exit(cli.Run(command))
+}
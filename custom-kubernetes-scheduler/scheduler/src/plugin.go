@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/jalawala/custom-kubernetes-scheduler/tree/main/admissionwebhook/pkg/placement"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Name of the plugin in the scheduler profile
+const Name = "CustomPodScheduleStrategy"
+
+const stateKey framework.StateKey = Name
+
+// Set by the webhook's splitter on child Deployments, which carry their node selector already
+const splitParentKey = "custom-pod-schedule-split-parent"
+
+// Places the pods of Deployments carrying a custom-pod-schedule-strategy with the same
+// semantics as the admission webhook, but at scheduling time:
+//
+//	PreFilter resolves the owner's strategy and counts its pods on each node label
+//	Filter    keeps the nodes of node labels that still miss pods
+//	Score     prefers the node labels missing the largest share of their pods
+//
+// Unlike the webhook, which pins the first under-filled node label before node fit is
+// known, a pod that does not fit one under-filled node label may still land on another.
+type CustomPodScheduleStrategy struct {
+	handle                     framework.Handle
+	deploymentLister           appslisters.DeploymentLister
+	replicaSetLister           appslisters.ReplicaSetLister
+	namespaceLister            corelisters.NamespaceLister
+	configMapLister            corelisters.ConfigMapLister
+	strategyTemplatesConfigMap string
+	priceTable                 string
+}
+
+var _ framework.PreFilterPlugin = &CustomPodScheduleStrategy{}
+var _ framework.FilterPlugin = &CustomPodScheduleStrategy{}
+var _ framework.PreScorePlugin = &CustomPodScheduleStrategy{}
+var _ framework.ScorePlugin = &CustomPodScheduleStrategy{}
+
+// Desired and current pods of one node label for the pod being scheduled
+type target struct {
+	nodeLabel string
+	desired   int
+	current   int
+}
+
+func (t *target) missing() int {
+	return t.desired - t.current
+}
+
+// Computed in PreFilter, read by Filter and Score
+type strategyState struct {
+	owner       string
+	strategy    string
+	targets     []target
+	underFilled bool // at least one node label misses pods
+}
+
+// The state is never modified after PreFilter
+func (s *strategyState) Clone() framework.StateData {
+	return s
+}
+
+// Creates the plugin. Strategy templates are read from the ConfigMap named by the
+// STRATEGY_TEMPLATES_CONFIGMAP environment variable ("namespace/name"), and the prices of
+// weight=auto from PRICE_TABLE (a file path or "configmap:namespace/name"), as in the webhook.
+func New(_ context.Context, _ runtime.Object, h framework.Handle) (framework.Plugin, error) {
+	informers := h.SharedInformerFactory()
+	return &CustomPodScheduleStrategy{
+		handle:                     h,
+		deploymentLister:           informers.Apps().V1().Deployments().Lister(),
+		replicaSetLister:           informers.Apps().V1().ReplicaSets().Lister(),
+		namespaceLister:            informers.Core().V1().Namespaces().Lister(),
+		configMapLister:            informers.Core().V1().ConfigMaps().Lister(),
+		strategyTemplatesConfigMap: os.Getenv("STRATEGY_TEMPLATES_CONFIGMAP"),
+		priceTable:                 strings.TrimSpace(os.Getenv("PRICE_TABLE")),
+	}, nil
+}
+
+func (p *CustomPodScheduleStrategy) Name() string {
+	return Name
+}
+
+func (p *CustomPodScheduleStrategy) PreFilter(ctx context.Context, state *framework.CycleState, pod *corev1.Pod) (*framework.PreFilterResult, *framework.Status) {
+	log := klog.FromContext(ctx).WithValues("plugin", Name)
+
+	deployment, err := p.ownerDeployment(pod)
+	if err != nil {
+		return nil, framework.AsStatus(err)
+	}
+	if deployment == nil || deployment.Annotations[splitParentKey] != "" {
+		return nil, framework.NewStatus(framework.Skip)
+	}
+
+	strategy, countingMode, err := p.resolveStrategy(deployment)
+	if err != nil {
+		return nil, framework.AsStatus(err)
+	}
+	if strategy == "" {
+		return nil, framework.NewStatus(framework.Skip)
+	}
+
+	owners, replicas, err := p.owners(deployment)
+	if err != nil {
+		return nil, framework.AsStatus(err)
+	}
+
+	if placement.UsesCostWeights(strategy) {
+		weightedStrategy, err := p.costWeightedStrategy(strategy)
+		if err != nil {
+			return nil, framework.AsStatus(err)
+		}
+		log.V(4).Info("derived cost-weighted strategy from the price table", "template", strategy, "strategy", weightedStrategy)
+		strategy = weightedStrategy
+	}
+
+	nodeLabelStrategyList, err := placement.Distribute(slog.New(logr.ToSlogHandler(log.V(4))), strategy, replicas)
+	if err != nil {
+		return nil, framework.NewStatus(framework.UnschedulableAndUnresolvable, err.Error())
+	}
+
+	current, err := p.countPods(pod, owners, nodeLabelStrategyList, countingMode)
+	if err != nil {
+		return nil, framework.AsStatus(err)
+	}
+
+	s := &strategyState{owner: deployment.Name, strategy: strategy}
+	for i, nodeLabelStrategy := range nodeLabelStrategyList {
+		t := target{nodeLabel: nodeLabelStrategy.NodeLabel, desired: nodeLabelStrategy.Replicas, current: current[i]}
+		s.targets = append(s.targets, t)
+		if t.missing() > 0 {
+			s.underFilled = true
+		}
+	}
+	state.Write(stateKey, s)
+
+	log.V(4).Info("computed strategy targets", "pod", klog.KObj(pod), "owner", s.owner, "strategy", s.strategy, "targets", s.targets)
+	return nil, nil
+}
+
+func (p *CustomPodScheduleStrategy) PreFilterExtensions() framework.PreFilterExtensions {
+	return nil
+}
+
+// Keeps the nodes of a node label that misses pods, or of any node label of the strategy
+// once all of them have their desired pods (e.g. during a rolling update surge)
+func (p *CustomPodScheduleStrategy) Filter(ctx context.Context, state *framework.CycleState, pod *corev1.Pod, nodeInfo *framework.NodeInfo) *framework.Status {
+	s, err := readState(state)
+	if err != nil {
+		return framework.AsStatus(err)
+	}
+
+	t := s.targetOf(nodeInfo.Node().Labels)
+	if t == nil {
+		return framework.NewStatus(framework.UnschedulableAndUnresolvable, "node matches no node label of the pod's strategy")
+	}
+	if s.underFilled && t.missing() <= 0 {
+		return framework.NewStatus(framework.Unschedulable, fmt.Sprintf("node label %s already runs its %d pods", t.nodeLabel, t.desired))
+	}
+	return nil
+}
+
+func (p *CustomPodScheduleStrategy) PreScore(ctx context.Context, state *framework.CycleState, pod *corev1.Pod, nodes []*framework.NodeInfo) *framework.Status {
+	if _, err := readState(state); err != nil {
+		return framework.NewStatus(framework.Skip)
+	}
+	return nil
+}
+
+// Scores a node by the share of its node label's desired pods that are still missing
+func (p *CustomPodScheduleStrategy) Score(ctx context.Context, state *framework.CycleState, pod *corev1.Pod, nodeName string) (int64, *framework.Status) {
+	s, err := readState(state)
+	if err != nil {
+		return 0, framework.AsStatus(err)
+	}
+
+	nodeInfo, err := p.handle.SnapshotSharedLister().NodeInfos().Get(nodeName)
+	if err != nil {
+		return 0, framework.AsStatus(err)
+	}
+
+	t := s.targetOf(nodeInfo.Node().Labels)
+	if t == nil || t.desired == 0 || t.missing() <= 0 {
+		return framework.MinNodeScore, nil
+	}
+	return int64(t.missing()) * framework.MaxNodeScore / int64(t.desired), nil
+}
+
+func (p *CustomPodScheduleStrategy) ScoreExtensions() framework.ScoreExtensions {
+	return nil
+}
+
+func readState(state *framework.CycleState) (*strategyState, error) {
+	data, err := state.Read(stateKey)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := data.(*strategyState)
+	if !ok {
+		return nil, fmt.Errorf("%+v cannot be converted to *strategyState", data)
+	}
+	return s, nil
+}
+
+// Returns the first target whose node label the node carries
+func (s *strategyState) targetOf(nodeLabels map[string]string) *target {
+	for i := range s.targets {
+		if placement.MatchesNodeLabel(nodeLabels, s.targets[i].nodeLabel) {
+			return &s.targets[i]
+		}
+	}
+	return nil
+}
+
+// Returns the Deployment controlling the pod through its ReplicaSet, or nil
+func (p *CustomPodScheduleStrategy) ownerDeployment(pod *corev1.Pod) (*appsv1.Deployment, error) {
+	for _, ownerReference := range pod.OwnerReferences {
+		if ownerReference.Controller == nil || !*ownerReference.Controller || ownerReference.Kind != "ReplicaSet" {
+			continue
+		}
+
+		replicaSet, err := p.replicaSetLister.ReplicaSets(pod.Namespace).Get(ownerReference.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, rsOwnerReference := range replicaSet.OwnerReferences {
+			if rsOwnerReference.Controller != nil && *rsOwnerReference.Controller && rsOwnerReference.Kind == "Deployment" {
+				return p.deploymentLister.Deployments(pod.Namespace).Get(rsOwnerReference.Name)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Resolves the strategy of a Deployment like the webhook does: an inline strategy on the
+// Deployment, a template referenced by the Deployment, then the same on its namespace.
+// Returns an empty strategy when none applies.
+func (p *CustomPodScheduleStrategy) resolveStrategy(deployment *appsv1.Deployment) (string, string, error) {
+	namespace, err := p.namespaceLister.Get(deployment.Namespace)
+	if err != nil {
+		return "", "", err
+	}
+
+	countingMode := deployment.Annotations[placement.CountingModeKey]
+	if countingMode == "" {
+		countingMode = namespace.Annotations[placement.CountingModeKey]
+	}
+
+	for _, annotations := range []map[string]string{deployment.Annotations, namespace.Annotations} {
+		if strategy := annotations[placement.StrategyKey]; strategy != "" {
+			return strategy, countingMode, nil
+		}
+		if templateName := annotations[placement.StrategyTemplateKey]; templateName != "" {
+			strategy, err := p.strategyTemplate(templateName)
+			return strategy, countingMode, err
+		}
+	}
+	return "", countingMode, nil
+}
+
+func (p *CustomPodScheduleStrategy) strategyTemplate(templateName string) (string, error) {
+	configMapNamespace, configMapName, ok := strings.Cut(p.strategyTemplatesConfigMap, "/")
+	if !ok || configMapNamespace == "" || configMapName == "" {
+		return "", fmt.Errorf("strategy template %s referenced but STRATEGY_TEMPLATES_CONFIGMAP=%q is not of the form namespace/name", templateName, p.strategyTemplatesConfigMap)
+	}
+
+	configMap, err := p.configMapLister.ConfigMaps(configMapNamespace).Get(configMapName)
+	if err != nil {
+		return "", fmt.Errorf("failed to get strategy templates ConfigMap %s: %v", p.strategyTemplatesConfigMap, err)
+	}
+
+	strategy := strings.TrimSpace(configMap.Data[templateName])
+	if strategy == "" {
+		return "", fmt.Errorf("strategy template %s not found in ConfigMap %s", templateName, p.strategyTemplatesConfigMap)
+	}
+	return strategy, nil
+}
+
+// Replaces the weight=auto targets of a strategy with weights derived from the price table.
+// Node labels missing from the table are priced as the average of the instance types of
+// the nodes carrying them.
+func (p *CustomPodScheduleStrategy) costWeightedStrategy(strategy string) (string, error) {
+	table, err := p.loadPriceTable()
+	if err != nil {
+		return "", err
+	}
+
+	nodeInfos, err := p.handle.SnapshotSharedLister().NodeInfos().List()
+	if err != nil {
+		return "", err
+	}
+
+	return placement.CostWeightedStrategy(strategy, func(nodeLabel string) (float64, float64, bool) {
+		if price, risk, ok := table.TargetPrice(nodeLabel); ok {
+			return price, risk, true
+		}
+
+		total, totalRisk, priced := 0.0, 0.0, 0
+		for _, nodeInfo := range nodeInfos {
+			if !placement.MatchesNodeLabel(nodeInfo.Node().Labels, nodeLabel) {
+				continue
+			}
+			if price, risk, ok := table.InstanceTypePrice(nodeInfo.Node().Labels[corev1.LabelInstanceTypeStable]); ok {
+				total += price
+				totalRisk += risk
+				priced++
+			}
+		}
+		if priced == 0 {
+			return 0, 0, false
+		}
+		return total / float64(priced), totalRisk / float64(priced), true
+	})
+}
+
+// Reads the price table named by PRICE_TABLE. A ConfigMap is read from the informer cache,
+// a file on every use, so that both follow price changes without a restart.
+func (p *CustomPodScheduleStrategy) loadPriceTable() (*placement.PriceTable, error) {
+	if p.priceTable == "" {
+		return nil, fmt.Errorf("weight=%s used but PRICE_TABLE is not set", placement.AutoWeight)
+	}
+
+	reference, ok := strings.CutPrefix(p.priceTable, "configmap:")
+	if !ok {
+		data, err := os.ReadFile(p.priceTable)
+		if err != nil {
+			return nil, err
+		}
+		return placement.ParsePriceTable(data)
+	}
+
+	configMapNamespace, configMapName, ok := strings.Cut(reference, "/")
+	if !ok {
+		return nil, fmt.Errorf("PRICE_TABLE %q is not of the form configmap:namespace/name", p.priceTable)
+	}
+	configMap, err := p.configMapLister.ConfigMaps(configMapNamespace).Get(configMapName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get price table ConfigMap %s: %v", reference, err)
+	}
+	return placement.ParsePriceTable([]byte(configMap.Data[placement.PriceTableConfigMapKey]))
+}
+
+// Returns the UIDs of the Deployments placed together with deployment, which are the
+// members of its quota group if it has one, and their combined replicas
+func (p *CustomPodScheduleStrategy) owners(deployment *appsv1.Deployment) (map[types.UID]bool, int, error) {
+	replicas := func(d *appsv1.Deployment) int {
+		if d.Spec.Replicas == nil {
+			return 1
+		}
+		return int(*d.Spec.Replicas)
+	}
+
+	group := deployment.Annotations[placement.GroupKey]
+	if group == "" {
+		return map[types.UID]bool{deployment.UID: true}, replicas(deployment), nil
+	}
+
+	deployments, err := p.deploymentLister.Deployments(deployment.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	owners := map[types.UID]bool{}
+	total := 0
+	for _, member := range deployments {
+		if member.Annotations[placement.GroupKey] == group {
+			owners[member.UID] = true
+			total += replicas(member)
+		}
+	}
+	return owners, total, nil
+}
+
+// Counts, per node label, the pods of the owners on nodes carrying that label. Pods the
+// scheduler has assumed but not yet bound are included, so consecutive pods of a rollout
+// see each other.
+func (p *CustomPodScheduleStrategy) countPods(pod *corev1.Pod, owners map[types.UID]bool, nodeLabelStrategyList []placement.NodeLabelStrategy, countingMode string) ([]int, error) {
+	replicaSets, err := p.replicaSetLister.ReplicaSets(pod.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	ownedReplicaSets := map[types.UID]bool{}
+	for _, replicaSet := range replicaSets {
+		for _, ownerReference := range replicaSet.OwnerReferences {
+			if owners[ownerReference.UID] {
+				ownedReplicaSets[replicaSet.UID] = true
+			}
+		}
+	}
+
+	nodeInfos, err := p.handle.SnapshotSharedLister().NodeInfos().List()
+	if err != nil {
+		return nil, err
+	}
+
+	podsPerNodeLabel := make([][]corev1.Pod, len(nodeLabelStrategyList))
+	for _, nodeInfo := range nodeInfos {
+		for i, nodeLabelStrategy := range nodeLabelStrategyList {
+			if !placement.MatchesNodeLabel(nodeInfo.Node().Labels, nodeLabelStrategy.NodeLabel) {
+				continue
+			}
+			for _, podInfo := range nodeInfo.Pods {
+				existing := podInfo.Pod
+				if existing.Namespace != pod.Namespace || existing.UID == pod.UID || existing.DeletionTimestamp != nil {
+					continue
+				}
+				for _, ownerReference := range existing.OwnerReferences {
+					if ownedReplicaSets[ownerReference.UID] {
+						podsPerNodeLabel[i] = append(podsPerNodeLabel[i], *existing)
+						break
+					}
+				}
+			}
+		}
+	}
+
+	counts := make([]int, len(nodeLabelStrategyList))
+	for i, pods := range podsPerNodeLabel {
+		counts[i] = placement.CountPods(pods, countingMode)
+	}
+	return counts, nil
+}
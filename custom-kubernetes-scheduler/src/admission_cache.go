@@ -0,0 +1,109 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remembers the responses of recent admissions, so that a request the API server retries
+// after a timeout gets the same patch instead of being placed, and counted, a second time
+type AdmissionCache struct {
+	sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List // least recently used at the back
+}
+
+type cachedAdmission struct {
+	key      string
+	response *v1beta1.AdmissionResponse
+	stored   time.Time
+}
+
+// Creates a cache of ADMISSION_CACHE_SIZE responses (default 1024, 0 disables caching)
+// kept for ADMISSION_CACHE_TTL (a Go duration or a number of minutes, default 2m)
+func NewAdmissionCacheFromEnv() (*AdmissionCache, error) {
+	size := 1024
+	if value := strings.TrimSpace(os.Getenv("ADMISSION_CACHE_SIZE")); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid ADMISSION_CACHE_SIZE %q", value)
+		}
+		size = parsed
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	ttl, err := durationFromEnv("ADMISSION_CACHE_TTL")
+	if err != nil {
+		return nil, err
+	}
+	if ttl == 0 {
+		ttl = 2 * time.Minute
+	}
+
+	return &AdmissionCache{size: size, ttl: ttl, entries: map[string]*list.Element{}, order: list.New()}, nil
+}
+
+// Identifies an admission by its request UID and the pod it admits
+func admissionCacheKey(req *v1beta1.AdmissionRequest, pod *corev1.Pod) string {
+	return strings.Join([]string{string(req.UID), req.Namespace, pod.Name, pod.GenerateName, pod.Labels["pod-template-hash"]}, "/")
+}
+
+// Returns a copy of the response stored for key, unless it has expired
+func (c *AdmissionCache) Get(key string) (*v1beta1.AdmissionResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cachedAdmission)
+	if time.Since(entry.stored) >= c.ttl {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	response := *entry.response
+	return &response, true
+}
+
+// Stores the response of an admission, evicting the least recently used one when full
+func (c *AdmissionCache) Put(key string, response *v1beta1.AdmissionResponse) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	stored := *response
+	if element, ok := c.entries[key]; ok {
+		element.Value = &cachedAdmission{key: key, response: &stored, stored: time.Now()}
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cachedAdmission{key: key, response: &stored, stored: time.Now()})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedAdmission).key)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes recorded in a placement decision
+const (
+	decisionOutcomePlaced    = "placed"    // a node selector was added to the pod
+	decisionOutcomeUnchanged = "unchanged" // the strategy was evaluated but no target needed more pods
+	decisionOutcomeSkipped   = "skipped"   // the pod is not managed by a strategy
+	decisionOutcomeError     = "error"     // the strategy could not be evaluated
+)
+
+// Append-only destination for placement decisions
+type AuditSink interface {
+	Record(decision *PlacementDecision)
+}
+
+// Everything that went into placing (or not placing) a single pod
+type PlacementDecision struct {
+	Time               time.Time           `json:"time"`
+	UID                string              `json:"uid"`
+	TraceID            string              `json:"traceId,omitempty"`
+	ServiceInstance    int                 `json:"serviceInstance"`
+	Namespace          string              `json:"namespace"`
+	Pod                string              `json:"pod"`
+	OwnerKind          string              `json:"ownerKind,omitempty"`
+	Owner              string              `json:"owner,omitempty"`
+	Group              string              `json:"group,omitempty"`
+	GroupMembers       []string            `json:"groupMembers,omitempty"`
+	Strategy           string              `json:"strategy,omitempty"`
+	StrategySource     string              `json:"strategySource,omitempty"`
+	Replicas           int                 `json:"replicas,omitempty"`
+	CountingMode       string              `json:"countingMode,omitempty"`
+	Targets            []TargetObservation `json:"targets,omitempty"`
+	ExpectedHourlyCost float64             `json:"expectedHourlyCost,omitempty"`
+	ChosenLabel        string              `json:"chosenLabel,omitempty"`
+	Shadow             bool                `json:"shadow,omitempty"`
+	Outcome            string              `json:"outcome"`
+	Reason             string              `json:"reason,omitempty"`
+}
+
+// Desired and observed pod counts for one node label at decision time
+type TargetObservation struct {
+	NodeLabel string `json:"nodeLabel"`
+	Desired   int    `json:"desired"`
+	Current   int    `json:"current"`
+}
+
+var auditSink AuditSink
+
+// Records the desired and current pod counts of a target
+func (d *PlacementDecision) observe(nodeLabel string, desired int, current int) {
+	d.Targets = append(d.Targets, TargetObservation{NodeLabel: nodeLabel, Desired: desired, Current: current})
+}
+
+func (d *PlacementDecision) conclude(outcome string, reason string) {
+	d.Outcome = outcome
+	d.Reason = reason
+}
+
+// Logs the decision with its inputs, appends it to the audit sink, if one is configured,
+// and emits an Event on the owner
+func recordDecision(ctx context.Context, decision *PlacementDecision) {
+	loggerFrom(ctx).Info("placement decision",
+		"owner", decision.Owner,
+		"group", decision.Group,
+		"strategy", decision.Strategy,
+		"strategySource", decision.StrategySource,
+		"replicas", decision.Replicas,
+		"countingMode", decision.CountingMode,
+		"counts", decision.Targets,
+		"chosenLabel", decision.ChosenLabel,
+		"outcome", decision.Outcome,
+		"reason", decision.Reason,
+		"shadow", decision.Shadow)
+
+	decisionsCounter.WithLabelValues(decision.Namespace, decision.Owner, decision.Outcome, strconv.FormatBool(decision.Shadow)).Inc()
+
+	shadowDecisions.Record(decision)
+	if auditSink != nil {
+		auditSink.Record(decision)
+	}
+	emitDecisionEvent(decision)
+}
+
+// Creates the audit sink described by target: an http(s) URL that every decision is
+// POSTed to, or a path (optionally prefixed with file://) of a JSON lines file.
+// An empty target disables auditing.
+func NewAuditSink(target string) (AuditSink, error) {
+	switch {
+	case target == "":
+		return nil, nil
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		return newHTTPAuditSink(target), nil
+	default:
+		return newFileAuditSink(strings.TrimPrefix(target, "file://"))
+	}
+}
+
+type fileAuditSink struct {
+	sync.Mutex
+	file *os.File
+}
+
+func newFileAuditSink(path string) (*fileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file %s: %v", path, err)
+	}
+	return &fileAuditSink{file: file}, nil
+}
+
+func (s *fileAuditSink) Record(decision *PlacementDecision) {
+	line, err := json.Marshal(decision)
+	if err != nil {
+		logger.Error("failed to encode placement decision", "uid", decision.UID, "error", err)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		logger.Error("failed to write placement decision to audit file", "uid", decision.UID, "error", err)
+	}
+}
+
+// Posts decisions from a bounded queue so a slow endpoint never delays admission
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+}
+
+const auditQueueSize = 1024
+
+func newHTTPAuditSink(url string) *httpAuditSink {
+	s := &httpAuditSink{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+		queue:  make(chan []byte, auditQueueSize),
+	}
+	go s.run()
+	return s
+}
+
+func (s *httpAuditSink) Record(decision *PlacementDecision) {
+	body, err := json.Marshal(decision)
+	if err != nil {
+		logger.Error("failed to encode placement decision", "uid", decision.UID, "error", err)
+		return
+	}
+
+	select {
+	case s.queue <- body:
+	default:
+		logger.Warn("audit queue is full, dropping placement decision", "uid", decision.UID)
+	}
+}
+
+func (s *httpAuditSink) run() {
+	for body := range s.queue {
+		resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logger.Error("failed to post placement decision", "url", s.url, "error", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logger.Error("audit endpoint rejected placement decision", "url", s.url, "status", resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Event reasons emitted on the owner of a placed pod
+const (
+	eventReasonPodPlaced       = "PodPlaced"
+	eventReasonPodShadowPlaced = "PodShadowPlaced"
+	eventReasonPlacementFailed = "PlacementFailed"
+
+	eventTraceIDAnnotation = "custom-kube-scheduler-webhook/trace-id"
+)
+
+var eventRecorder record.EventRecorder
+
+// Creates an event recorder that writes Events through the given clientset
+func NewEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: tracerName})
+}
+
+// API versions of the owner kinds Events are emitted on
+var ownerAPIVersions = map[string]string{
+	"Deployment": "apps/v1",
+	"Job":        "batch/v1",
+}
+
+// Emits an Event on the owning Deployment or Job for decisions that placed a pod or failed to.
+// Pods grouped by a group key alone have no owner object and get no Event.
+// The trace ID, when present, is carried both in the message and as an annotation.
+func emitDecisionEvent(decision *PlacementDecision) {
+	if eventRecorder == nil || decision.Owner == "" || decision.OwnerKind == "" {
+		return
+	}
+
+	owner := &corev1.ObjectReference{
+		Kind:       decision.OwnerKind,
+		APIVersion: ownerAPIVersions[decision.OwnerKind],
+		Namespace:  decision.Namespace,
+		Name:       decision.Owner,
+	}
+
+	var annotations map[string]string
+	suffix := ""
+	if decision.TraceID != "" {
+		annotations = map[string]string{eventTraceIDAnnotation: decision.TraceID}
+		suffix = " traceId=" + decision.TraceID
+	}
+
+	switch {
+	case decision.Outcome == decisionOutcomePlaced && decision.Shadow:
+		eventRecorder.AnnotatedEventf(owner, annotations, corev1.EventTypeNormal, eventReasonPodShadowPlaced,
+			"Pod %s would be placed on %s, shadow mode left it unpatched%s", decision.Pod, decision.ChosenLabel, suffix)
+	case decision.Outcome == decisionOutcomePlaced:
+		eventRecorder.AnnotatedEventf(owner, annotations, corev1.EventTypeNormal, eventReasonPodPlaced,
+			"Pod %s placed on %s%s", decision.Pod, decision.ChosenLabel, suffix)
+	case decision.Outcome == decisionOutcomeError:
+		eventRecorder.AnnotatedEventf(owner, annotations, corev1.EventTypeWarning, eventReasonPlacementFailed,
+			"Pod %s not placed: %s%s", decision.Pod, decision.Reason, suffix)
+	}
+}
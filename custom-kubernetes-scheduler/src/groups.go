@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+)
+
+// Deployments of one namespace sharing a strategy and pool budget through the
+// custom-pod-schedule-group annotation
+type QuotaGroup struct {
+	Name     string
+	Members  []string
+	Replicas int
+}
+
+// Returns the members of a quota group and their combined replicas. Every Deployment in
+// the namespace whose custom-pod-schedule-group annotation equals group is a member.
+// Members whose strategy annotations differ from the ones in ownerAnnotations are still
+// counted, but logged, since the group is placed with a single strategy.
+func GetQuotaGroup(ctx context.Context, namespace string, group string, ownerAnnotations map[string]string) (*QuotaGroup, error) {
+	ctx, span := tracer.Start(ctx, "GetQuotaGroup", trace.WithAttributes(attribute.String("placement.group", group)))
+	defer span.End()
+
+	log := loggerFrom(ctx)
+
+	deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		err = fmt.Errorf("failed to list deployments for group %s: %v", group, err)
+		spanError(span, err)
+		return nil, err
+	}
+
+	quotaGroup := &QuotaGroup{Name: group}
+	for _, deployment := range deployments.Items {
+		if deployment.Annotations[customPodScheduleGroupKey] != group {
+			continue
+		}
+
+		if deployment.Annotations[customPodScheduleStrategyKey] != ownerAnnotations[customPodScheduleStrategyKey] ||
+			deployment.Annotations[customPodScheduleStrategyTemplateKey] != ownerAnnotations[customPodScheduleStrategyTemplateKey] {
+			log.Warn("group member declares a different strategy, placing the group with the strategy of the current owner", "group", group, "member", deployment.Name)
+		}
+
+		replicas := 1
+		if deployment.Spec.Replicas != nil {
+			replicas = int(*deployment.Spec.Replicas)
+		}
+		quotaGroup.Members = append(quotaGroup.Members, deployment.Name)
+		quotaGroup.Replicas += replicas
+	}
+	sort.Strings(quotaGroup.Members)
+
+	span.SetAttributes(attribute.StringSlice("placement.group_members", quotaGroup.Members), attribute.Int("placement.replicas", quotaGroup.Replicas))
+	log.Debug("resolved quota group", "group", group, "members", quotaGroup.Members, "replicas", quotaGroup.Replicas)
+	return quotaGroup, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+var logger = NewLogger("", "")
+
+type loggerContextKey struct{}
+
+// Builds the process logger. level is one of TRACE, DEBUG, INFO (default), WARN or ERROR
+// and format is either json (default) or text.
+func NewLogger(level string, format string) *slog.Logger {
+	var logLevel slog.Level
+	switch strings.ToUpper(level) {
+	case "TRACE", "DEBUG":
+		logLevel = slog.LevelDebug
+	case "WARN":
+		logLevel = slog.LevelWarn
+	case "ERROR":
+		logLevel = slog.LevelError
+	default:
+		logLevel = slog.LevelInfo
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	if strings.ToLower(format) == "text" {
+		return slog.New(slog.NewTextHandler(os.Stderr, options))
+	}
+	return slog.New(slog.NewJSONHandler(os.Stderr, options))
+}
+
+// Returns a copy of ctx carrying a logger that already has the request scoped fields attached
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, l)
+}
+
+// Returns the request scoped logger stored in ctx, or the process logger when there is none
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
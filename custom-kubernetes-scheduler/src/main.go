@@ -4,18 +4,18 @@ import (
 	"context"
 	"crypto/tls"
 	"flag"
-	"fmt"
-	"github.com/golang/glog"
+	"k8s.io/client-go/dynamic"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var (
-	AppLogLevel          string
-	BlockedNameSpaceList []string
+	BlockedNameSpaceList       []string
+	StrategyTemplatesConfigMap string
 )
 
 /*
@@ -25,31 +25,122 @@ var (
 */
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(RunReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "shadow-report" {
+		os.Exit(RunShadowReport(os.Args[2:]))
+	}
+
 	var parameters WhSvrParameters
 
 	// get command line parameters
 	flag.IntVar(&parameters.port, "port", 8443, "Webhook server port.")
 	flag.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
+	flag.IntVar(&parameters.metricsPort, "metricsPort", 8080, "Plain HTTP port serving Prometheus metrics, 0 disables it.")
+	flag.StringVar(&parameters.tlsMinVersion, "tlsMinVersion", "1.2", "Minimum TLS version, 1.2 or 1.3.")
+	flag.StringVar(&parameters.tlsCipherSuites, "tlsCipherSuites", "", "Comma-separated IANA names of the TLS 1.2 cipher suites, empty for Go's secure defaults.")
+	flag.StringVar(&parameters.tlsClientCAFile, "tlsClientCAFile", "", "File containing the CA bundle verifying client certificates, e.g. the API server's front-proxy CA. Empty disables client authentication.")
+	flag.StringVar(&parameters.tlsClientNames, "tlsClientNames", "", "Comma-separated common names allowed for client certificates, empty allows any name signed by --tlsClientCAFile.")
+	flag.BoolVar(&parameters.enableHTTP2, "enableHTTP2", false, "Offer HTTP/2 besides HTTP/1.1.")
+	flag.Int64Var(&parameters.maxRequestBodyBytes, "maxRequestBodyBytes", 3*1024*1024, "Largest AdmissionReview accepted, in bytes.")
+	flag.DurationVar(&parameters.readTimeout, "readTimeout", 10*time.Second, "Time allowed to read a request.")
+	flag.DurationVar(&parameters.writeTimeout, "writeTimeout", 30*time.Second, "Time allowed to write a response.")
+	flag.DurationVar(&parameters.idleTimeout, "idleTimeout", 120*time.Second, "Time keep-alive connections stay open between requests.")
 	flag.Parse()
 
-	AppLogLevel = os.Getenv("LOG_LEVEL")
+	logger = NewLogger(os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"))
 
 	BlockedNameSpaceList = strings.Split(os.Getenv("BLOCKLISTED_NAMESPACE_LIST"), ",")
+	StrategyTemplatesConfigMap = os.Getenv("STRATEGY_TEMPLATES_CONFIGMAP")
+	shadowMode = os.Getenv("SHADOW_MODE") == "true"
+
+	logger.Info("starting webhook server", "logLevel", os.Getenv("LOG_LEVEL"), "blockedNamespaceList", BlockedNameSpaceList, "strategyTemplatesConfigMap", StrategyTemplatesConfigMap, "shadowMode", shadowMode)
+
+	config, err := InitClientset()
+	if err != nil {
+		logger.Error("failed to connect to the cluster", "error", err)
+		os.Exit(1)
+	}
 
-	glog.Infof("AppLogLevel=%s BlockedNameSpaceList=%v", AppLogLevel, BlockedNameSpaceList)
+	sink, err := NewAuditSink(os.Getenv("AUDIT_SINK"))
+	if err != nil {
+		logger.Error("failed to create audit sink", "error", err)
+		os.Exit(1)
+	}
+	auditSink = sink
+
+	shutdownTracing, err := InitTracing(context.Background())
+	if err != nil {
+		logger.Error("failed to initialise tracing", "error", err)
+		os.Exit(1)
+	}
+
+	eventRecorder = NewEventRecorder(clientset)
+
+	prices, err = NewPriceSourceFromEnv()
+	if err != nil {
+		logger.Error("invalid price table configuration", "error", err)
+		os.Exit(1)
+	}
+
+	if parameters.metricsPort != 0 {
+		go ServeMetrics(parameters.metricsPort)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		logger.Error("failed to create dynamic client", "error", err)
+		os.Exit(1)
+	}
+	nodePools, err = NewNodePoolTrackerFromEnv(dynamicClient)
+	if err != nil {
+		logger.Error("invalid NodePool configuration", "error", err)
+		os.Exit(1)
+	}
+
+	reconcilerConfig, err := NewReconcilerConfigFromEnv()
+	if err != nil {
+		logger.Error("invalid reconciler configuration", "error", err)
+		os.Exit(1)
+	}
+	reconcilerCtx, stopReconciler := context.WithCancel(context.Background())
+	if reconcilerConfig.Enabled() {
+		go NewReconciler(*reconcilerConfig).Run(reconcilerCtx)
+	}
+
+	splitter, err := NewSplitterFromEnv()
+	if err != nil {
+		logger.Error("invalid splitter configuration", "error", err)
+		os.Exit(1)
+	}
+	if splitter.Enabled() {
+		go splitter.Run(reconcilerCtx)
+	}
 
 	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
 	if err != nil {
-		glog.Errorf("Failed to load key pair: %v", err)
+		logger.Error("failed to load key pair", "error", err)
+	}
+
+	admissions, err := NewAdmissionCacheFromEnv()
+	if err != nil {
+		logger.Error("invalid admission cache configuration", "error", err)
+		os.Exit(1)
+	}
+
+	tlsConfig, err := NewTLSConfig(parameters, pair)
+	if err != nil {
+		logger.Error("invalid TLS configuration", "error", err)
+		os.Exit(1)
 	}
 
 	whsvr := &WebhookServer{
 
-		server: &http.Server{
-			Addr:      fmt.Sprintf(":%v", parameters.port),
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
-		},
+		server:              NewWebhookHTTPServer(parameters, tlsConfig),
+		maxRequestBodyBytes: parameters.maxRequestBodyBytes,
+		admissions:          admissions,
 	}
 
 	// define http server and server handler
@@ -61,7 +152,7 @@ func main() {
 	go func() {
 
 		if err := whsvr.server.ListenAndServeTLS("", ""); err != nil {
-			glog.Errorf("Failed to listen and serve webhook server: %v", err)
+			logger.Error("failed to listen and serve webhook server", "error", err)
 		}
 	}()
 
@@ -70,6 +161,8 @@ func main() {
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChan
 
-	glog.Infof("Got OS shutdown signal, shutting down webhook server gracefully...")
+	logger.Info("got OS shutdown signal, shutting down webhook server gracefully")
+	stopReconciler()
 	whsvr.server.Shutdown(context.Background())
+	shutdownTracing(context.Background())
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	expectedHourlyCostGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "custom_pod_schedule_expected_hourly_cost",
+		Help: "Hourly cost of the replica spread computed for an owner, from the price table.",
+	}, []string{"namespace", "owner"})
+
+	desiredReplicasGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "custom_pod_schedule_desired_replicas",
+		Help: "Replicas the strategy of an owner wants on a node label.",
+	}, []string{"namespace", "owner", "node_label"})
+
+	decisionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "custom_pod_schedule_decisions_total",
+		Help: "Placement decisions by outcome, shadow decisions are recorded without patching the pod.",
+	}, []string{"namespace", "owner", "outcome", "shadow"})
+
+	admissionCacheHitsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "custom_pod_schedule_admission_cache_hits_total",
+		Help: "Retried admissions answered from the admission cache without placing the pod again.",
+	}, []string{"namespace"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		expectedHourlyCostGauge,
+		desiredReplicasGauge,
+		decisionsCounter,
+		admissionCacheHitsCounter,
+	)
+}
+
+// Serves the Prometheus metrics over plain HTTP on /metrics
+func ServeMetrics(port int) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	if err := http.ListenAndServe(fmt.Sprintf(":%v", port), mux); err != nil {
+		logger.Error("failed to serve metrics", "error", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jalawala/custom-kubernetes-scheduler/tree/main/admissionwebhook/pkg/placement"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"os"
+	"sync"
+	"time"
+)
+
+// Checks Karpenter NodePools against their spec.limits, so that pods are not routed to a
+// pool that cannot provision any more capacity
+type NodePoolTracker struct {
+	sync.Mutex
+	client   dynamic.Interface
+	resource schema.GroupVersionResource
+	ttl      time.Duration
+	cache    map[string]nodePoolLimitState
+}
+
+type nodePoolLimitState struct {
+	atLimit bool
+	reason  string
+	checked time.Time
+}
+
+var nodePools *NodePoolTracker
+
+// Creates a tracker for the NodePools of KARPENTER_NODEPOOL_API_VERSION (default v1).
+// Results are cached for KARPENTER_NODEPOOL_CACHE_TTL (minutes or a Go duration, default 30s).
+func NewNodePoolTrackerFromEnv(client dynamic.Interface) (*NodePoolTracker, error) {
+	version := os.Getenv("KARPENTER_NODEPOOL_API_VERSION")
+	if version == "" {
+		version = "v1"
+	}
+
+	ttl := 30 * time.Second
+	if os.Getenv("KARPENTER_NODEPOOL_CACHE_TTL") != "" {
+		duration, err := durationFromEnv("KARPENTER_NODEPOOL_CACHE_TTL")
+		if err != nil {
+			return nil, err
+		}
+		ttl = duration
+	}
+
+	return &NodePoolTracker{
+		client:   client,
+		resource: schema.GroupVersionResource{Group: "karpenter.sh", Version: version, Resource: "nodepools"},
+		ttl:      ttl,
+		cache:    map[string]nodePoolLimitState{},
+	}, nil
+}
+
+// Reports whether the NodePool targeted by nodeLabel has reached one of its limits, and
+// which. Node labels that do not target a NodePool, unknown NodePools and lookup failures
+// are never at their limit.
+func (t *NodePoolTracker) AtLimit(ctx context.Context, nodeLabel string) (bool, string) {
+	if t == nil {
+		return false, ""
+	}
+	name := placement.NodePoolOf(nodeLabel)
+	if name == "" {
+		return false, ""
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if state, ok := t.cache[name]; ok && time.Since(state.checked) < t.ttl {
+		return state.atLimit, state.reason
+	}
+
+	state := nodePoolLimitState{checked: time.Now()}
+	nodePool, err := t.client.Resource(t.resource).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			loggerFrom(ctx).Warn("failed to get NodePool, assuming it has capacity left", "nodePool", name, "error", err)
+		}
+		t.cache[name] = state
+		return false, ""
+	}
+
+	state.atLimit, state.reason = nodePoolAtLimit(nodePool)
+	t.cache[name] = state
+	if state.atLimit {
+		loggerFrom(ctx).Info("NodePool has reached its limit", "nodePool", name, "reason", state.reason)
+	}
+	return state.atLimit, state.reason
+}
+
+// Compares the resources a NodePool has provisioned (status.resources) with its spec.limits
+func nodePoolAtLimit(nodePool *unstructured.Unstructured) (bool, string) {
+	// quantities may be written as numbers (cpu: 100) as well as strings (memory: 1000Gi)
+	limits, _, _ := unstructured.NestedMap(nodePool.Object, "spec", "limits")
+	provisioned, _, _ := unstructured.NestedMap(nodePool.Object, "status", "resources")
+
+	for name, value := range limits {
+		limit, err := resource.ParseQuantity(fmt.Sprint(value))
+		if err != nil {
+			continue
+		}
+		used, err := resource.ParseQuantity(fmt.Sprint(provisioned[name]))
+		if err != nil {
+			continue
+		}
+		if used.Cmp(limit) >= 0 {
+			return true, fmt.Sprintf("%s %s of limit %s in use", name, used.String(), limit.String())
+		}
+	}
+	return false, ""
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jalawala/custom-kubernetes-scheduler/tree/main/admissionwebhook/pkg/placement"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"strconv"
+	"time"
+)
+
+// Annotation on a pod (or the pod template of a Job) fixing how many pods its group spreads.
+// Without it the group is sized by its live pods plus the pod being admitted.
+const customPodScheduleGroupSizeKey = "custom-pod-schedule-group-size"
+
+// Reports whether a pod declares its own strategy or group key, as bare pods and the pods of
+// Jobs do through their template annotations. Pods of Deployments are placed by their owner.
+func podHasOwnStrategy(pod *corev1.Pod) bool {
+	if pod.Labels["pod-template-hash"] != "" {
+		return false
+	}
+	for _, key := range []string{customPodScheduleStrategyKey, customPodScheduleStrategyTemplateKey, customPodScheduleGroupKey} {
+		if pod.Annotations[key] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Pods spread together by a pod-level strategy: the pods of the namespace sharing the
+// custom-pod-schedule-group annotation, else the pods of the same controller, e.g. a Job.
+// A bare pod without group key is a group of its own.
+type podGroup struct {
+	kind          string // kind of the controller owning the pods, empty for groups by key
+	name          string
+	groupKey      string
+	controllerUID types.UID
+}
+
+func podGroupOf(pod *corev1.Pod) podGroup {
+	if groupKey := pod.Annotations[customPodScheduleGroupKey]; groupKey != "" {
+		return podGroup{name: groupKey, groupKey: groupKey}
+	}
+	if controller := metav1.GetControllerOf(pod); controller != nil {
+		return podGroup{kind: controller.Kind, name: controller.Name, controllerUID: controller.UID}
+	}
+	if pod.Name != "" {
+		return podGroup{name: pod.Name}
+	}
+	return podGroup{name: pod.GenerateName}
+}
+
+func (g podGroup) has(pod *corev1.Pod) bool {
+	if g.groupKey != "" {
+		return pod.Annotations[customPodScheduleGroupKey] == g.groupKey
+	}
+	if g.controllerUID != "" {
+		controller := metav1.GetControllerOf(pod)
+		return controller != nil && controller.UID == g.controllerUID
+	}
+	return false
+}
+
+// Returns the live pods of a group. Pods that have completed, as finished Job pods have,
+// no longer hold capacity and are left out.
+func GetGroupPods(ctx context.Context, namespace string, group podGroup) ([]corev1.Pod, error) {
+	ctx, span := tracer.Start(ctx, "GetGroupPods", trace.WithAttributes(attribute.String("placement.group", group.name)))
+	defer span.End()
+
+	time.Sleep(podListDelay) // this is to give enough time for concurrent writes to etcd from other mutatting requests
+	pods, err := api.Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		spanError(span, err)
+		return nil, err
+	}
+
+	members := []corev1.Pod{}
+	for _, pod := range pods.Items {
+		if !group.has(&pod) || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		members = append(members, pod)
+	}
+	return members, nil
+}
+
+// Places a pod carrying its own strategy annotations. The strategy is resolved from the pod
+// annotations, falling back to the namespace, and the pods are counted across its group.
+func ProcessPod(ctx context.Context, decision *PlacementDecision, nameSpace string, pod *corev1.Pod) (map[string]string, bool) {
+
+	nodeselectors := make(map[string]string)
+	group := podGroupOf(pod)
+
+	log := loggerFrom(ctx).With("flow", "CREATE", "owner", group.name)
+	ctx = withLogger(ctx, log)
+	decision.OwnerKind, decision.Owner = group.kind, group.name
+	decision.Group = group.groupKey
+
+	resolvedStrategy, resolveErr := ResolveStrategy(ctx, nameSpace, pod.Annotations)
+	if resolveErr != nil {
+		log.Error("failed to resolve custom scheduling strategy", "error", resolveErr)
+		decision.conclude(decisionOutcomeError, resolveErr.Error())
+		return nodeselectors, false
+	}
+	if resolvedStrategy == nil {
+		decision.conclude(decisionOutcomeSkipped, "no strategy on the pod or its namespace")
+		return nodeselectors, true
+	}
+
+	strategy := resolvedStrategy.Strategy
+	countingMode := GetPodCountingMode(ctx, resolvedStrategy.CountingMode)
+
+	if placement.UsesCostWeights(strategy) {
+		weightedStrategy, costErr := CostWeightedStrategy(ctx, strategy)
+		if costErr != nil {
+			log.Error("failed to derive cost-weighted strategy", "strategy", strategy, "error", costErr)
+			decision.conclude(decisionOutcomeError, costErr.Error())
+			return nodeselectors, false
+		}
+		log.Info("derived cost-weighted strategy from the price table", "template", strategy, "strategy", weightedStrategy)
+		strategy = weightedStrategy
+	}
+
+	members, listErr := GetGroupPods(ctx, nameSpace, group)
+	if listErr != nil {
+		log.Error("failed to get pods of the group", "error", listErr)
+		decision.conclude(decisionOutcomeError, fmt.Sprintf("failed to get pods of %s: %v", group.name, listErr))
+		return nodeselectors, false
+	}
+
+	numOfReplicas := len(members) + 1
+	if size := pod.Annotations[customPodScheduleGroupSizeKey]; size != "" {
+		groupSize, err := strconv.Atoi(size)
+		if err != nil || groupSize < 1 {
+			log.Error("invalid group size", "groupSize", size)
+			decision.conclude(decisionOutcomeError, fmt.Sprintf("invalid %s %q", customPodScheduleGroupSizeKey, size))
+			return nodeselectors, false
+		}
+		numOfReplicas = groupSize
+	}
+
+	log.Info("found pod with custom scheduling strategy", "replicas", numOfReplicas, "livePods", len(members), "strategy", strategy, "strategySource", resolvedStrategy.Source, "countingMode", countingMode)
+	decision.Strategy = strategy
+	decision.StrategySource = resolvedStrategy.Source
+	decision.CountingMode = countingMode
+	decision.Shadow = shadowMode || resolvedStrategy.Shadow
+	decision.Replicas = numOfReplicas
+
+	return PlaceByStrategy(ctx, decision, nameSpace, group.name, strategy, numOfReplicas, countingMode, "CREATE", func(ctx context.Context, nodeLabel string) ([]corev1.Pod, bool) {
+		if decision.Shadow {
+			return shadowDecisions.PodsOn(decision, members, nodeLabel), true
+		}
+		onNodeLabel := []corev1.Pod{}
+		for _, member := range members {
+			if placement.MatchesNodeLabel(member.Spec.NodeSelector, nodeLabel) {
+				onNodeLabel = append(onNodeLabel, member)
+			}
+		}
+		return onNodeLabel, true
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jalawala/custom-kubernetes-scheduler/tree/main/admissionwebhook/pkg/placement"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Loads the price table from a file or a ConfigMap and reloads it once it is older than
+// the refresh interval, so that strategies with weight=auto follow price changes
+type PriceSource struct {
+	sync.Mutex
+	location string // file path or configmap:namespace/name
+	refresh  time.Duration
+	table    *placement.PriceTable
+	loaded   time.Time
+}
+
+var prices *PriceSource
+
+// Reads PRICE_TABLE (a file path or "configmap:namespace/name") and PRICE_TABLE_REFRESH
+// (a Go duration or a number of minutes, default 5m). Returns nil when no table is set.
+func NewPriceSourceFromEnv() (*PriceSource, error) {
+	location := strings.TrimSpace(os.Getenv("PRICE_TABLE"))
+	if location == "" {
+		return nil, nil
+	}
+
+	refresh, err := durationFromEnv("PRICE_TABLE_REFRESH")
+	if err != nil {
+		return nil, err
+	}
+	if refresh == 0 {
+		refresh = 5 * time.Minute
+	}
+	return &PriceSource{location: location, refresh: refresh}, nil
+}
+
+// Returns the current price table, reloading it when stale. A table that fails to reload
+// keeps being used until the next attempt.
+func (p *PriceSource) Table(ctx context.Context) (*placement.PriceTable, error) {
+	if p == nil {
+		return nil, fmt.Errorf("weight=%s used but PRICE_TABLE is not set", placement.AutoWeight)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.table != nil && time.Since(p.loaded) < p.refresh {
+		return p.table, nil
+	}
+
+	table, err := p.load(ctx)
+	if err != nil {
+		if p.table != nil {
+			loggerFrom(ctx).Warn("failed to reload price table, keeping the previous one", "priceTable", p.location, "error", err)
+			return p.table, nil
+		}
+		return nil, err
+	}
+
+	loggerFrom(ctx).Info("loaded price table", "priceTable", p.location, "targets", len(table.Targets), "instanceTypes", len(table.InstanceTypes))
+	p.table, p.loaded = table, time.Now()
+	return table, nil
+}
+
+func (p *PriceSource) load(ctx context.Context) (*placement.PriceTable, error) {
+	var data []byte
+
+	if reference, ok := strings.CutPrefix(p.location, "configmap:"); ok {
+		configMapNamespace, configMapName, ok := strings.Cut(reference, "/")
+		if !ok {
+			return nil, fmt.Errorf("PRICE_TABLE %q is not of the form configmap:namespace/name", p.location)
+		}
+		configMap, err := clientset.CoreV1().ConfigMaps(configMapNamespace).Get(ctx, configMapName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get price table ConfigMap %s: %v", reference, err)
+		}
+		data = []byte(configMap.Data[placement.PriceTableConfigMapKey])
+	} else {
+		fileData, err := ioutil.ReadFile(p.location)
+		if err != nil {
+			return nil, err
+		}
+		data = fileData
+	}
+
+	return placement.ParsePriceTable(data)
+}
+
+// Returns a price lookup for the given table. Node labels listed in the table use their
+// price; others are priced as the average of the instance types of the nodes carrying them.
+func priceFunc(ctx context.Context, table *placement.PriceTable) placement.PriceFunc {
+	return func(nodeLabel string) (float64, float64, bool) {
+		if price, risk, ok := table.TargetPrice(nodeLabel); ok {
+			return price, risk, true
+		}
+		if len(table.InstanceTypes) == 0 {
+			return 0, 0, false
+		}
+
+		nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: nodeLabel})
+		if err != nil {
+			loggerFrom(ctx).Warn("failed to list nodes to price node label", "nodeLabel", nodeLabel, "error", err)
+			return 0, 0, false
+		}
+
+		total, totalRisk, priced := 0.0, 0.0, 0
+		for _, node := range nodes.Items {
+			if price, risk, ok := table.InstanceTypePrice(node.Labels[corev1.LabelInstanceTypeStable]); ok {
+				total += price
+				totalRisk += risk
+				priced++
+			}
+		}
+		if priced == 0 {
+			return 0, 0, false
+		}
+		return total / float64(priced), totalRisk / float64(priced), true
+	}
+}
+
+// Replaces the weight=auto targets of a strategy with weights derived from the price table
+func CostWeightedStrategy(ctx context.Context, strategy string) (string, error) {
+	table, err := prices.Table(ctx)
+	if err != nil {
+		return "", err
+	}
+	return placement.CostWeightedStrategy(strategy, priceFunc(ctx, table))
+}
+
+// Returns the hourly cost of the distributed replicas when a price table is configured
+// and prices every node label with replicas
+func ExpectedHourlyCost(ctx context.Context, nodeLabelStrategyList []NodeLabelStrategy) (float64, bool) {
+	if prices == nil {
+		return 0, false
+	}
+	table, err := prices.Table(ctx)
+	if err != nil {
+		loggerFrom(ctx).Warn("failed to load price table", "error", err)
+		return 0, false
+	}
+	return placement.ExpectedHourlyCost(nodeLabelStrategyList, priceFunc(ctx, table))
+}
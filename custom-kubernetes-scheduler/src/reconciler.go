@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	appsv1 "k8s.io/api/apps/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Label selecting the namespaces the webhook (and so the reconciler) acts on
+const webhookNamespaceSelector = "custom-kube-scheduler-webhook=enabled"
+
+// Reconciler passes
+const (
+	reconcilePassDrift     = "drift"     // corrects misplaced pods under an unchanged strategy
+	reconcilePassMigration = "migration" // moves pods towards a changed strategy and reports progress
+)
+
+// Reconciler settings, read from the RECONCILER_* and MIGRATION_* environment variables
+type ReconcilerConfig struct {
+	Period                      time.Duration
+	MaxEvictions                int // evictions allowed per run across all workloads
+	MaxEvictionsPerWorkload     int // evictions allowed per run for a single workload or quota group
+	MaintenanceWindow           *MaintenanceWindow
+	MigrationInterval           time.Duration
+	MigrationMaxPodsPerInterval int // evictions allowed per migration interval for a single workload or quota group
+}
+
+// Daily UTC time range, which may wrap past midnight (e.g. 22:00-04:00)
+type MaintenanceWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// Periodically moves pods from over-provisioned node labels to under-provisioned ones
+type Reconciler struct {
+	config ReconcilerConfig
+}
+
+// Pods that may still be evicted in the current run
+type disruptionBudget struct {
+	remaining int
+}
+
+// Reads the reconciler settings. RECONCILER_PERIOD and MIGRATION_INTERVAL are either Go
+// durations or a number of minutes; zero or empty disables the corresponding pass.
+func NewReconcilerConfigFromEnv() (*ReconcilerConfig, error) {
+	config := &ReconcilerConfig{MaxEvictions: 1, MaxEvictionsPerWorkload: 1, MigrationMaxPodsPerInterval: 1}
+
+	for env, target := range map[string]*time.Duration{
+		"RECONCILER_PERIOD":  &config.Period,
+		"MIGRATION_INTERVAL": &config.MigrationInterval,
+	} {
+		duration, err := durationFromEnv(env)
+		if err != nil {
+			return nil, err
+		}
+		*target = duration
+	}
+
+	for env, target := range map[string]*int{
+		"RECONCILER_MAX_EVICTIONS":              &config.MaxEvictions,
+		"RECONCILER_MAX_EVICTIONS_PER_WORKLOAD": &config.MaxEvictionsPerWorkload,
+		"MIGRATION_MAX_PODS_PER_INTERVAL":       &config.MigrationMaxPodsPerInterval,
+	} {
+		if value := strings.TrimSpace(os.Getenv(env)); value != "" {
+			number, err := strconv.Atoi(value)
+			if err != nil || number < 0 {
+				return nil, fmt.Errorf("invalid %s %q", env, value)
+			}
+			*target = number
+		}
+	}
+
+	window, err := ParseMaintenanceWindow(os.Getenv("RECONCILER_MAINTENANCE_WINDOW"))
+	if err != nil {
+		return nil, err
+	}
+	config.MaintenanceWindow = window
+
+	return config, nil
+}
+
+// Reads a period from the environment, either a Go duration or a number of minutes.
+// An unset variable yields zero.
+func durationFromEnv(env string) (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv(env))
+	if value == "" {
+		return 0, nil
+	}
+	if minutes, err := strconv.Atoi(value); err == nil {
+		return time.Duration(minutes) * time.Minute, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return duration, nil
+	}
+	return 0, fmt.Errorf("invalid %s %q", env, value)
+}
+
+// Parses "HH:MM-HH:MM" (UTC). An empty window means the reconciler may run at any time.
+func ParseMaintenanceWindow(window string) (*MaintenanceWindow, error) {
+	window = strings.TrimSpace(window)
+	if window == "" {
+		return nil, nil
+	}
+
+	start, end, ok := strings.Cut(window, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid maintenance window %q, expected HH:MM-HH:MM", window)
+	}
+
+	parse := func(clock string) (time.Duration, error) {
+		t, err := time.Parse("15:04", strings.TrimSpace(clock))
+		if err != nil {
+			return 0, fmt.Errorf("invalid maintenance window %q: %v", window, err)
+		}
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+	}
+
+	startOffset, err := parse(start)
+	if err != nil {
+		return nil, err
+	}
+	endOffset, err := parse(end)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MaintenanceWindow{start: startOffset, end: endOffset}, nil
+}
+
+// Reports whether t falls inside the window. A nil window always contains t.
+func (w *MaintenanceWindow) Contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+
+	t = t.UTC()
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start <= w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+func NewReconciler(config ReconcilerConfig) *Reconciler {
+	return &Reconciler{config: config}
+}
+
+// Reports whether either pass is enabled
+func (c *ReconcilerConfig) Enabled() bool {
+	return c.Period > 0 || c.MigrationInterval > 0
+}
+
+// Runs the drift pass every period, within the maintenance window, and the migration pass
+// every migration interval until ctx is cancelled
+func (r *Reconciler) Run(ctx context.Context) {
+	logger.Info("starting reconciler", "period", r.config.Period, "maxEvictions", r.config.MaxEvictions,
+		"maxEvictionsPerWorkload", r.config.MaxEvictionsPerWorkload, "migrationInterval", r.config.MigrationInterval,
+		"migrationMaxPodsPerInterval", r.config.MigrationMaxPodsPerInterval)
+
+	var driftTicks, migrationTicks <-chan time.Time
+	if r.config.Period > 0 {
+		ticker := time.NewTicker(r.config.Period)
+		defer ticker.Stop()
+		driftTicks = ticker.C
+	}
+	if r.config.MigrationInterval > 0 {
+		ticker := time.NewTicker(r.config.MigrationInterval)
+		defer ticker.Stop()
+		migrationTicks = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-driftTicks:
+			if !r.config.MaintenanceWindow.Contains(time.Now()) {
+				logger.Debug("outside maintenance window, skipping reconcile")
+				continue
+			}
+			r.reconcile(ctx, reconcilePassDrift)
+		case <-migrationTicks:
+			r.reconcile(ctx, reconcilePassMigration)
+		}
+	}
+}
+
+// Single pass over every strategy-managed Deployment in the namespaces the webhook serves
+func (r *Reconciler) reconcile(ctx context.Context, pass string) {
+	ctx, span := tracer.Start(ctx, "Reconcile", trace.WithAttributes(attribute.String("reconcile.pass", pass)))
+	defer span.End()
+
+	log := logger.With("flow", "DELETE", "pass", pass)
+	ctx = withLogger(ctx, log)
+
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: webhookNamespaceSelector})
+	if err != nil {
+		log.Error("failed to list namespaces", "error", err)
+		spanError(span, err)
+		return
+	}
+
+	// migrations are paced per workload only
+	budget := &disruptionBudget{remaining: r.config.MaxEvictions}
+	if pass == reconcilePassMigration {
+		budget.remaining = math.MaxInt
+	}
+	reconciledGroups := map[string]bool{}
+
+	for _, namespace := range namespaces.Items {
+		if !mutationRequired(ignoredNamespaces, &namespace.ObjectMeta) {
+			continue
+		}
+
+		deployments, err := clientset.AppsV1().Deployments(namespace.Name).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			log.Error("failed to list deployments", "namespace", namespace.Name, "error", err)
+			continue
+		}
+
+		for i := range deployments.Items {
+			if budget.remaining <= 0 {
+				log.Info("disruption budget exhausted for this run")
+				return
+			}
+
+			deployment := &deployments.Items[i]
+			if group := deployment.Annotations[customPodScheduleGroupKey]; group != "" {
+				groupKey := namespace.Name + "/" + group
+				if reconciledGroups[groupKey] {
+					continue
+				}
+				reconciledGroups[groupKey] = true
+			}
+
+			r.reconcileDeployment(ctx, pass, budget, deployment)
+		}
+	}
+}
+
+// Compares the per-label pod counts of a Deployment (or its quota group) with the strategy.
+// The drift pass evicts misplaced pods when the strategy is unchanged; the migration pass
+// does so, at its own pace, after the strategy changed and maintains the status annotation.
+func (r *Reconciler) reconcileDeployment(ctx context.Context, pass string, budget *disruptionBudget, deployment *appsv1.Deployment) {
+	settled := deploymentIsSettled(deployment)
+	if pass == reconcilePassDrift && !settled {
+		loggerFrom(ctx).Debug("deployment is rolling out or has unavailable replicas, skipping", "namespace", deployment.Namespace, "owner", deployment.Name)
+		return
+	}
+
+	ctx, span := tracer.Start(ctx, "ReconcileDeployment", trace.WithAttributes(
+		attribute.String("k8s.namespace.name", deployment.Namespace),
+		attribute.String("placement.owner", deployment.Name),
+	))
+	defer span.End()
+
+	log := loggerFrom(ctx).With("namespace", deployment.Namespace)
+	ctx = withLogger(ctx, log)
+
+	decision := &PlacementDecision{Time: time.Now().UTC(), Namespace: deployment.Namespace}
+	if _, ok := ProcessDeployment(ctx, decision, deployment.Namespace, deployment.Name, "DELETE"); !ok || decision.Strategy == "" {
+		return
+	}
+	if decision.Shadow {
+		log.Debug("strategy is in shadow mode, leaving the pods alone", "owner", decision.Owner)
+		return
+	}
+
+	ownerNames := []string{deployment.Name}
+	if decision.Group != "" {
+		ownerNames = decision.GroupMembers
+	}
+
+	previous := GetScheduleStatus(deployment)
+	migrating := previous != nil && (previous.Phase == scheduleStatusMigrating || previous.Strategy != decision.Strategy)
+
+	switch pass {
+	case reconcilePassDrift:
+		if migrating && r.config.MigrationInterval > 0 {
+			log.Debug("strategy is migrating, leaving the deployment to the migration pass", "owner", decision.Owner)
+			return
+		}
+		r.evictMisplacedPods(ctx, decision, ownerNames, r.config.MaxEvictionsPerWorkload, budget)
+
+	case reconcilePassMigration:
+		status := &ScheduleStatus{
+			Strategy:           decision.Strategy,
+			Phase:              scheduleStatusSettled,
+			Targets:            decision.Targets,
+			MisplacedPods:      misplacedPods(decision),
+			ExpectedHourlyCost: decision.ExpectedHourlyCost,
+			LastUpdateTime:     time.Now().UTC(),
+		}
+
+		if migrating {
+			status.PreviousStrategy = previous.PreviousStrategy
+			status.MigratedPods = previous.MigratedPods
+			if previous.Strategy != decision.Strategy {
+				log.Info("strategy changed, migrating pods", "owner", decision.Owner, "previousStrategy", previous.Strategy, "strategy", decision.Strategy)
+				status.PreviousStrategy = previous.Strategy
+				status.MigratedPods = 0
+			}
+
+			if status.MisplacedPods > 0 {
+				status.Phase = scheduleStatusMigrating
+				if settled {
+					status.MigratedPods += r.evictMisplacedPods(ctx, decision, ownerNames, r.config.MigrationMaxPodsPerInterval, budget)
+				} else {
+					log.Info("waiting for the deployment to become ready before migrating more pods", "owner", decision.Owner)
+				}
+			} else {
+				log.Info("strategy migration complete", "owner", decision.Owner, "migratedPods", status.MigratedPods)
+			}
+		} else if status.MisplacedPods > 0 {
+			status.Phase = scheduleStatusDrifted
+		}
+
+		if !status.changedFrom(previous) {
+			return
+		}
+		for _, ownerName := range ownerNames {
+			if err := UpdateScheduleStatus(ctx, deployment.Namespace, ownerName, status); err != nil {
+				log.Error("failed to update schedule status", "owner", ownerName, "error", err)
+				spanError(span, err)
+			}
+		}
+	}
+}
+
+// Number of pods running on node labels beyond what the strategy wants there
+func misplacedPods(decision *PlacementDecision) int {
+	misplaced := 0
+	for _, target := range decision.Targets {
+		if target.Current > target.Desired {
+			misplaced += target.Current - target.Desired
+		}
+	}
+	return misplaced
+}
+
+// Evicts pods from over-provisioned node labels, no more than there are missing pods on
+// under-provisioned labels, so that their replacements are placed where they are needed.
+// At most limit pods are evicted for the workload, and never more than the run's budget.
+// Returns the number of pods evicted.
+func (r *Reconciler) evictMisplacedPods(ctx context.Context, decision *PlacementDecision, ownerNames []string, limit int, budget *disruptionBudget) int {
+	log := loggerFrom(ctx)
+
+	// pods missing on node pools at their limit could not be placed there
+	missing := 0
+	for _, target := range decision.Targets {
+		if atLimit, _ := nodePools.AtLimit(ctx, target.NodeLabel); target.Current < target.Desired && !atLimit {
+			missing += target.Desired - target.Current
+		}
+	}
+
+	total := 0
+	for _, target := range decision.Targets {
+		excess := target.Current - target.Desired
+		if excess <= 0 {
+			continue
+		}
+
+		toEvict := min(excess, missing, limit-total, budget.remaining)
+		if toEvict <= 0 {
+			log.Info("node label is over-provisioned but nothing can be evicted now", "owner", decision.Owner, "nodeLabel", target.NodeLabel,
+				"excess", excess, "missing", missing, "workloadBudget", limit-total, "runBudget", budget.remaining)
+			continue
+		}
+
+		pods, ok := GetNumOfExistingPods(ctx, decision.Namespace, ownerNames, target.NodeLabel)
+		if !ok {
+			continue
+		}
+
+		evicted := EvictPods(ctx, decision.Namespace, OrderPodsForDeletion(pods), toEvict)
+		log.Info("evicted pods from over-provisioned node label", "owner", decision.Owner, "group", decision.Group,
+			"nodeLabel", target.NodeLabel, "current", target.Current, "desired", target.Desired, "evicted", evicted)
+
+		missing -= evicted
+		total += evicted
+		budget.remaining -= evicted
+	}
+	return total
+}
+
+// A Deployment is only rebalanced when every replica is updated and available
+func deploymentIsSettled(deployment *appsv1.Deployment) bool {
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	return deployment.Status.ObservedGeneration >= deployment.Generation &&
+		deployment.Status.UpdatedReplicas == replicas &&
+		deployment.Status.AvailableReplicas == replicas &&
+		deployment.Status.UnavailableReplicas == 0
+}
+
+// Evicts up to numOfPodsToBeEvicted pods in the given order through the Eviction API, so
+// PodDisruptionBudgets are honoured. Stops at the first eviction refused by a PDB and
+// returns the number of pods evicted.
+func EvictPods(ctx context.Context, nameSpace string, podNames []string, numOfPodsToBeEvicted int) int {
+	log := loggerFrom(ctx)
+
+	evicted := 0
+	for i := 0; i < numOfPodsToBeEvicted && i < len(podNames); i++ {
+		podName := podNames[i]
+		log.Info("evicting pod", "index", i, "name", podName)
+		err := clientset.CoreV1().Pods(nameSpace).Evict(ctx, &policyv1beta1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{Name: podName, Namespace: nameSpace},
+		})
+		if apierrors.IsTooManyRequests(err) {
+			log.Info("eviction refused by a PodDisruptionBudget", "name", podName)
+			break
+		}
+		if err != nil {
+			log.Error("failed to evict pod", "name", podName, "error", err)
+			continue
+		}
+		evicted++
+	}
+	return evicted
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/ghodss/yaml"
+	"github.com/jalawala/custom-kubernetes-scheduler/tree/main/admissionwebhook/pkg/placement"
+	"io"
+	"io/ioutil"
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Cluster state and a sequence of admissions and pod lifecycle events replayed against the
+// webhook logic with a fake clientset
+type ReplayScenario struct {
+	Namespaces  []corev1.Namespace  `json:"namespaces,omitempty"`
+	Deployments []appsv1.Deployment `json:"deployments,omitempty"`
+	ConfigMaps  []corev1.ConfigMap  `json:"configMaps,omitempty"`
+	Nodes       []corev1.Node       `json:"nodes,omitempty"`
+
+	StrategyTemplatesConfigMap string `json:"strategyTemplatesConfigMap,omitempty"` // namespace/name, as STRATEGY_TEMPLATES_CONFIGMAP
+	PriceTable                 string `json:"priceTable,omitempty"`                 // price table document, as in PRICE_TABLE
+
+	Events []ReplayEvent `json:"events"`
+}
+
+// One step of a scenario, exactly one field is set
+type ReplayEvent struct {
+	Admit    *ReplayAdmission `json:"admit,omitempty"`
+	Bind     *ReplayPodEvent  `json:"bind,omitempty"`
+	Ready    *ReplayPodEvent  `json:"ready,omitempty"`
+	Delete   *ReplayPodEvent  `json:"delete,omitempty"`
+	Scale    *ReplayScale     `json:"scale,omitempty"`
+	Annotate *ReplayAnnotate  `json:"annotate,omitempty"`
+}
+
+// Pod CREATE admissions, either a recorded AdmissionReview or pods of a Deployment
+type ReplayAdmission struct {
+	Review          *v1beta1.AdmissionReview `json:"review,omitempty"`
+	Namespace       string                   `json:"namespace,omitempty"`
+	Deployment      string                   `json:"deployment,omitempty"`
+	PodTemplateHash string                   `json:"podTemplateHash,omitempty"`
+	Count           int                      `json:"count,omitempty"`  // pods admitted, default 1
+	Expect          *string                  `json:"expect,omitempty"` // node label every admitted pod must get, "" for none
+}
+
+// Pods a lifecycle event applies to: the named pod, or the first count pods of the
+// Deployment the event has not been applied to yet
+type ReplayPodEvent struct {
+	Namespace  string `json:"namespace"`
+	Pod        string `json:"pod,omitempty"`
+	Deployment string `json:"deployment,omitempty"`
+	Count      int    `json:"count,omitempty"`
+	Node       string `json:"node,omitempty"` // for bind, defaults to the first node matching the pod's node selector
+}
+
+type ReplayScale struct {
+	Namespace  string `json:"namespace"`
+	Deployment string `json:"deployment"`
+	Replicas   int32  `json:"replicas"`
+}
+
+type ReplayAnnotate struct {
+	Namespace   string            `json:"namespace"`
+	Deployment  string            `json:"deployment"`
+	Annotations map[string]string `json:"annotations"` // an empty value removes the annotation
+}
+
+// Outcome of one replayed admission
+type ReplayResult struct {
+	Step     int    `json:"step"`
+	Pod      string `json:"pod"`
+	Owner    string `json:"owner,omitempty"`
+	Outcome  string `json:"outcome,omitempty"`
+	Label    string `json:"nodeLabel"` // the node label chosen by a shadow decision for unpatched pods
+	Shadow   bool   `json:"shadow,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Mismatch bool   `json:"mismatch,omitempty"`
+}
+
+// Final pods per node label of one owner
+type ReplayPlacement struct {
+	Namespace string         `json:"namespace"`
+	Owner     string         `json:"owner"`
+	Labels    map[string]int `json:"labels"`
+}
+
+type ReplayReport struct {
+	Admissions []ReplayResult    `json:"admissions"`
+	Placements []ReplayPlacement `json:"placements"`
+	Mismatches int               `json:"mismatches"`
+}
+
+// Collects the decisions of the replayed admissions
+type replayAuditSink struct {
+	sync.Mutex
+	decisions []*PlacementDecision
+}
+
+func (s *replayAuditSink) Record(decision *PlacementDecision) {
+	s.Lock()
+	defer s.Unlock()
+	s.decisions = append(s.decisions, decision)
+}
+
+func (s *replayAuditSink) last() *PlacementDecision {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.decisions) == 0 {
+		return nil
+	}
+	return s.decisions[len(s.decisions)-1]
+}
+
+// Entry point of "custom-kube-scheduler-webhook replay". Replays a YAML scenario or an
+// audit log written by AUDIT_SINK and prints the resulting placement per node label.
+// Returns the process exit code: 1 when an admission got another node label than expected.
+func RunReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	scenarioFile := flags.String("scenario", "", "YAML scenario file to replay.")
+	auditFile := flags.String("audit", "", "Audit log (JSON lines of placement decisions) to replay, expecting the recorded node labels.")
+	output := flags.String("o", "text", "Report format, text or json.")
+	logLevel := flags.String("logLevel", "WARN", "Log level of the replayed webhook logic.")
+	flags.Parse(args)
+
+	logger = NewLogger(*logLevel, "text")
+
+	var scenario *ReplayScenario
+	var err error
+	switch {
+	case *scenarioFile != "":
+		scenario, err = LoadReplayScenario(*scenarioFile)
+	case *auditFile != "":
+		scenario, err = ScenarioFromAuditLog(*auditFile)
+	default:
+		err = fmt.Errorf("one of -scenario or -audit is required")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	report, err := Replay(context.Background(), scenario)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		report.Print(os.Stdout)
+	}
+
+	if report.Mismatches > 0 {
+		return 1
+	}
+	return 0
+}
+
+func LoadReplayScenario(file string) (*ReplayScenario, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	scenario := &ReplayScenario{}
+	if err := yaml.Unmarshal(data, scenario); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %v", file, err)
+	}
+	return scenario, nil
+}
+
+// Builds a scenario from recorded placement decisions. Each owner becomes a Deployment
+// carrying the recorded strategy, counting mode and replicas, updated whenever a later
+// decision recorded different ones, and each decision an admission expecting the recorded
+// node label. Decisions of groups and of other owners, e.g. Jobs, become admissions of pods
+// carrying the recorded strategy, group and group size themselves, and are skipped when no
+// strategy was recorded for them. Pod lifecycle is not recorded, so admitted pods are
+// assumed to stay.
+func ScenarioFromAuditLog(file string) (*ReplayScenario, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scenario := &ReplayScenario{}
+	namespaces := map[string]bool{}
+	owners := map[string]*appsv1.Deployment{}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		decision := &PlacementDecision{}
+		if err := json.Unmarshal(scanner.Bytes(), decision); err != nil {
+			return nil, fmt.Errorf("invalid audit record: %v", err)
+		}
+		if decision.Owner == "" || decision.Outcome == decisionOutcomeError {
+			continue
+		}
+
+		if !namespaces[decision.Namespace] {
+			namespaces[decision.Namespace] = true
+			scenario.Namespaces = append(scenario.Namespaces, corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: decision.Namespace}})
+		}
+
+		if decision.Group != "" || decision.OwnerKind != "Deployment" {
+			if decision.Strategy == "" {
+				logger.Warn("skipping audit record, no strategy was recorded for the pod", "namespace", decision.Namespace, "owner", decision.Owner, "ownerKind", decision.OwnerKind, "group", decision.Group, "outcome", decision.Outcome)
+				continue
+			}
+			admission, err := podAdmissionOf(decision, len(scenario.Events))
+			if err != nil {
+				return nil, err
+			}
+			scenario.Events = append(scenario.Events, ReplayEvent{Admit: admission})
+			continue
+		}
+
+		annotations := map[string]string{
+			customPodScheduleStrategyKey:     decision.Strategy,
+			customPodScheduleCountingModeKey: decision.CountingMode,
+		}
+		key := decision.Namespace + "/" + decision.Owner
+		if owner, ok := owners[key]; !ok {
+			replicas := int32(decision.Replicas)
+			owner = &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: decision.Owner, Namespace: decision.Namespace, Annotations: annotations},
+				Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			}
+			owners[key] = owner
+			scenario.Deployments = append(scenario.Deployments, *owner)
+		} else {
+			if owner.Annotations[customPodScheduleStrategyKey] != decision.Strategy || owner.Annotations[customPodScheduleCountingModeKey] != decision.CountingMode {
+				owner.Annotations = annotations
+				scenario.Events = append(scenario.Events, ReplayEvent{Annotate: &ReplayAnnotate{Namespace: decision.Namespace, Deployment: decision.Owner, Annotations: annotations}})
+			}
+			if int(*owner.Spec.Replicas) != decision.Replicas {
+				replicas := int32(decision.Replicas)
+				owner.Spec.Replicas = &replicas
+				scenario.Events = append(scenario.Events, ReplayEvent{Scale: &ReplayScale{Namespace: decision.Namespace, Deployment: decision.Owner, Replicas: replicas}})
+			}
+		}
+
+		expected := decision.ChosenLabel
+		scenario.Events = append(scenario.Events, ReplayEvent{Admit: &ReplayAdmission{
+			Namespace:       decision.Namespace,
+			Deployment:      decision.Owner,
+			PodTemplateHash: podTemplateHashOf(decision.Pod, decision.Owner),
+			Expect:          &expected,
+		}})
+	}
+	return scenario, scanner.Err()
+}
+
+// Builds the admission of a pod placed by its own annotations, as the recorded decision
+// placed it: across the pods sharing its group key, else the pods of its controller
+func podAdmissionOf(decision *PlacementDecision, step int) (*ReplayAdmission, error) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: decision.Pod,
+			Namespace:    decision.Namespace,
+			Annotations: map[string]string{
+				customPodScheduleStrategyKey:     decision.Strategy,
+				customPodScheduleCountingModeKey: decision.CountingMode,
+				customPodScheduleGroupSizeKey:    strconv.Itoa(decision.Replicas),
+			},
+		},
+	}
+	switch {
+	case decision.Group != "":
+		pod.Annotations[customPodScheduleGroupKey] = decision.Group
+	case decision.OwnerKind != "":
+		controller := true
+		pod.OwnerReferences = []metav1.OwnerReference{{
+			Kind:       decision.OwnerKind,
+			Name:       decision.Owner,
+			UID:        types.UID(decision.Namespace + "/" + decision.OwnerKind + "/" + decision.Owner),
+			Controller: &controller,
+		}}
+	case pod.GenerateName == "":
+		// a bare pod without group key is a group of its own, named by the pod
+		pod.Name = decision.Owner
+	}
+	if pod.Name == "" && pod.GenerateName == "" {
+		pod.GenerateName = decision.Owner + "-"
+	}
+
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+	expected := decision.ChosenLabel
+	return &ReplayAdmission{
+		Review: &v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+			UID:       types.UID(fmt.Sprintf("replay-%d", step)),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: decision.Namespace,
+			Operation: v1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		}},
+		Expect: &expected,
+	}, nil
+}
+
+// Recovers the pod-template-hash from a generateName of the form <owner>-<hash>-
+func podTemplateHashOf(generateName string, owner string) string {
+	hash := strings.Trim(strings.TrimPrefix(generateName, owner), "-")
+	if hash == "" {
+		return "replay"
+	}
+	return hash
+}
+
+// Replays a scenario against the webhook logic and returns the placements it produced.
+// Replaces the package-level clientset, sinks and settings for the duration of the replay.
+func Replay(ctx context.Context, scenario *ReplayScenario) (*ReplayReport, error) {
+	client := fake.NewSimpleClientset()
+	clientset = client
+	api = client.CoreV1()
+	podListDelay = 0
+	eventRecorder = nil
+	nodePools = nil
+	StrategyTemplatesConfigMap = scenario.StrategyTemplatesConfigMap
+
+	sink := &replayAuditSink{}
+	auditSink = sink
+
+	prices = nil
+	if scenario.PriceTable != "" {
+		table, err := placement.ParsePriceTable([]byte(scenario.PriceTable))
+		if err != nil {
+			return nil, fmt.Errorf("invalid price table: %v", err)
+		}
+		prices = &PriceSource{location: "scenario", refresh: math.MaxInt64, table: table, loaded: time.Now()}
+	}
+
+	for i := range scenario.Namespaces {
+		if _, err := client.CoreV1().Namespaces().Create(ctx, &scenario.Namespaces[i], metav1.CreateOptions{}); err != nil {
+			return nil, err
+		}
+	}
+	for i := range scenario.ConfigMaps {
+		if _, err := client.CoreV1().ConfigMaps(scenario.ConfigMaps[i].Namespace).Create(ctx, &scenario.ConfigMaps[i], metav1.CreateOptions{}); err != nil {
+			return nil, err
+		}
+	}
+	for i := range scenario.Nodes {
+		if _, err := client.CoreV1().Nodes().Create(ctx, &scenario.Nodes[i], metav1.CreateOptions{}); err != nil {
+			return nil, err
+		}
+	}
+	for i := range scenario.Deployments {
+		deployment := &scenario.Deployments[i]
+		if deployment.Spec.Replicas == nil {
+			replicas := int32(1)
+			deployment.Spec.Replicas = &replicas
+		}
+		if _, err := client.AppsV1().Deployments(deployment.Namespace).Create(ctx, deployment, metav1.CreateOptions{}); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &replayer{whsvr: &WebhookServer{}, sink: sink, report: &ReplayReport{}, owners: map[string]string{}, shadow: map[string]string{}, start: time.Now(), applied: map[string]map[string]bool{}}
+	for step, event := range scenario.Events {
+		var err error
+		switch {
+		case event.Admit != nil:
+			err = r.admit(ctx, step, event.Admit)
+		case event.Bind != nil:
+			err = r.podEvent(ctx, "bind", event.Bind, func(pod *corev1.Pod) { r.bind(ctx, pod, event.Bind.Node) })
+		case event.Ready != nil:
+			err = r.podEvent(ctx, "ready", event.Ready, func(pod *corev1.Pod) {
+				pod.Status.Conditions = append(pod.Status.Conditions, corev1.PodCondition{Type: corev1.PodReady, Status: corev1.ConditionTrue})
+			})
+		case event.Delete != nil:
+			err = r.deletePods(ctx, event.Delete)
+		case event.Scale != nil:
+			err = r.updateDeployment(ctx, event.Scale.Namespace, event.Scale.Deployment, func(deployment *appsv1.Deployment) {
+				deployment.Spec.Replicas = &event.Scale.Replicas
+			})
+		case event.Annotate != nil:
+			err = r.updateDeployment(ctx, event.Annotate.Namespace, event.Annotate.Deployment, func(deployment *appsv1.Deployment) {
+				if deployment.Annotations == nil {
+					deployment.Annotations = map[string]string{}
+				}
+				for key, value := range event.Annotate.Annotations {
+					if value == "" {
+						delete(deployment.Annotations, key)
+					} else {
+						deployment.Annotations[key] = value
+					}
+				}
+			})
+		default:
+			err = fmt.Errorf("empty event")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %v", step, err)
+		}
+	}
+
+	return r.report, r.collectPlacements(ctx)
+}
+
+type replayer struct {
+	whsvr   *WebhookServer
+	sink    *replayAuditSink
+	report  *ReplayReport
+	podNum  int
+	pods    []string                   // pod names in admission order
+	owners  map[string]string          // pod name to owner name
+	shadow  map[string]string          // pod name to the node label of its shadow decision
+	start   time.Time
+	applied map[string]map[string]bool // lifecycle event to the pods it was applied to
+}
+
+func (r *replayer) admit(ctx context.Context, step int, admission *ReplayAdmission) error {
+	count := admission.Count
+	if count == 0 || admission.Review != nil {
+		count = 1
+	}
+
+	for i := 0; i < count; i++ {
+		review := admission.Review
+		if review == nil {
+			hash := admission.PodTemplateHash
+			if hash == "" {
+				hash = "replay"
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					GenerateName: admission.Deployment + "-" + hash + "-",
+					Namespace:    admission.Namespace,
+					Labels:       map[string]string{"pod-template-hash": hash},
+				},
+			}
+			raw, err := json.Marshal(pod)
+			if err != nil {
+				return err
+			}
+			review = &v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+				UID:       types.UID(fmt.Sprintf("replay-%d-%d", step, i)),
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Namespace: admission.Namespace,
+				Operation: v1beta1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			}}
+		}
+
+		response := r.whsvr.mutate(ctx, review, 0)
+
+		pod := &corev1.Pod{}
+		if err := json.Unmarshal(review.Request.Object.Raw, pod); err != nil {
+			return err
+		}
+		if response.Patch != nil {
+			jsonPatch, err := jsonpatch.DecodePatch(response.Patch)
+			if err != nil {
+				return fmt.Errorf("invalid patch %s: %v", response.Patch, err)
+			}
+			// patch the pod as the API server would hold it, with every field of the spec
+			// present even when the scenario's review leaves it out
+			document, err := json.Marshal(pod)
+			if err != nil {
+				return err
+			}
+			patched, err := jsonPatch.Apply(document)
+			if err != nil {
+				return fmt.Errorf("invalid patch %s: %v", response.Patch, err)
+			}
+			pod = &corev1.Pod{}
+			if err := json.Unmarshal(patched, pod); err != nil {
+				return err
+			}
+		}
+
+		r.podNum++
+		if pod.Name == "" {
+			pod.Name = pod.GenerateName + strconv.Itoa(r.podNum)
+		}
+		if pod.Namespace == "" {
+			pod.Namespace = review.Request.Namespace
+		}
+		// distinct creation times keep the admission order, which shadow decisions are matched by
+		pod.CreationTimestamp = metav1.NewTime(r.start.Add(time.Duration(r.podNum) * time.Millisecond))
+		pod.Status.Phase = corev1.PodPending
+		if _, err := clientset.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		r.pods = append(r.pods, pod.Name)
+
+		result := ReplayResult{Step: step, Pod: pod.Name, Label: nodeLabelOf(pod.Spec.NodeSelector)}
+		if decision := r.sink.last(); decision != nil && decision.UID == string(review.Request.UID) {
+			result.Owner, result.Outcome = decision.Owner, decision.Outcome
+			r.owners[pod.Name] = decision.Owner
+			if decision.Shadow && decision.ChosenLabel != "" {
+				result.Label, result.Shadow = nodeLabelOf(placement.NodeSelectorOf(decision.ChosenLabel)), true
+				r.shadow[pod.Name] = result.Label
+			}
+		}
+		if admission.Expect != nil {
+			result.Expected = *admission.Expect
+			result.Mismatch = !sameNodeLabel(result.Label, result.Expected)
+			if result.Mismatch {
+				r.report.Mismatches++
+			}
+		}
+		r.report.Admissions = append(r.report.Admissions, result)
+	}
+	return nil
+}
+
+// Applies fn to the pods selected by the event and writes them back
+func (r *replayer) podEvent(ctx context.Context, kind string, event *ReplayPodEvent, fn func(pod *corev1.Pod)) error {
+	pods, err := r.selectPods(ctx, kind, event)
+	if err != nil {
+		return err
+	}
+	for i := range pods {
+		fn(&pods[i])
+		if _, err := clientset.CoreV1().Pods(pods[i].Namespace).Update(ctx, &pods[i], metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *replayer) deletePods(ctx context.Context, event *ReplayPodEvent) error {
+	pods, err := r.selectPods(ctx, "delete", event)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if err := clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *replayer) selectPods(ctx context.Context, kind string, event *ReplayPodEvent) ([]corev1.Pod, error) {
+	if event.Pod != "" {
+		pod, err := clientset.CoreV1().Pods(event.Namespace).Get(ctx, event.Pod, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return []corev1.Pod{*pod}, nil
+	}
+
+	list, err := clientset.CoreV1().Pods(event.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]corev1.Pod{}
+	for _, pod := range list.Items {
+		existing[pod.Name] = pod
+	}
+
+	if r.applied[kind] == nil {
+		r.applied[kind] = map[string]bool{}
+	}
+	count := event.Count
+	if count == 0 {
+		count = 1
+	}
+
+	pods := []corev1.Pod{}
+	for _, podName := range r.pods {
+		pod, ok := existing[podName]
+		if len(pods) == count {
+			break
+		}
+		if !ok || r.owners[pod.Name] != event.Deployment || r.applied[kind][pod.Name] {
+			continue
+		}
+		r.applied[kind][pod.Name] = true
+		pods = append(pods, pod)
+	}
+	if len(pods) < count {
+		return nil, fmt.Errorf("%s: only %d of %d pods of %s/%s left", kind, len(pods), count, event.Namespace, event.Deployment)
+	}
+	return pods, nil
+}
+
+// Binds the pod to the given node, or the first node of the scenario matching its node
+// selector, and marks it running
+func (r *replayer) bind(ctx context.Context, pod *corev1.Pod, nodeName string) {
+	if nodeName == "" {
+		nodeName = "replay-node"
+		if nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{}); err == nil {
+			for _, node := range nodes.Items {
+				if placement.MatchesNodeLabel(node.Labels, nodeLabelOf(pod.Spec.NodeSelector)) || len(pod.Spec.NodeSelector) == 0 {
+					nodeName = node.Name
+					break
+				}
+			}
+		}
+	}
+	pod.Spec.NodeName = nodeName
+	pod.Status.Phase = corev1.PodRunning
+}
+
+func (r *replayer) updateDeployment(ctx context.Context, namespace string, name string, fn func(deployment *appsv1.Deployment)) error {
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	fn(deployment)
+	_, err = clientset.AppsV1().Deployments(namespace).Update(ctx, deployment, metav1.UpdateOptions{})
+	return err
+}
+
+// Counts the remaining pods of every owner per node label
+func (r *replayer) collectPlacements(ctx context.Context) error {
+	pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	placements := map[string]*ReplayPlacement{}
+	for _, pod := range pods.Items {
+		owner := r.owners[pod.Name]
+		key := pod.Namespace + "/" + owner
+		if placements[key] == nil {
+			placements[key] = &ReplayPlacement{Namespace: pod.Namespace, Owner: owner, Labels: map[string]int{}}
+		}
+		label := nodeLabelOf(pod.Spec.NodeSelector)
+		if shadowLabel, ok := r.shadow[pod.Name]; ok {
+			label = shadowLabel
+		}
+		placements[key].Labels[label]++
+	}
+
+	keys := make([]string, 0, len(placements))
+	for key := range placements {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		r.report.Placements = append(r.report.Placements, *placements[key])
+	}
+	return nil
+}
+
+// Prints the admissions and final placements as tables
+func (report *ReplayReport) Print(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tPOD\tOWNER\tOUTCOME\tNODE LABEL\tEXPECTED")
+	for _, result := range report.Admissions {
+		expected := result.Expected
+		if result.Mismatch {
+			expected += "  MISMATCH"
+		}
+		outcome := result.Outcome
+		if result.Shadow {
+			outcome += " (shadow)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", result.Step, result.Pod, result.Owner, outcome, valueOrNone(result.Label), expected)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "NAMESPACE\tOWNER\tNODE LABEL\tPODS")
+	for _, placement := range report.Placements {
+		labels := make([]string, 0, len(placement.Labels))
+		for label := range placement.Labels {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", placement.Namespace, placement.Owner, valueOrNone(label), placement.Labels[label])
+		}
+	}
+	fmt.Fprintf(w, "\n%d admissions, %d mismatches\n", len(report.Admissions), report.Mismatches)
+	w.Flush()
+}
+
+func valueOrNone(value string) string {
+	if value == "" {
+		return "<none>"
+	}
+	return value
+}
+
+// Renders a node selector as a strategy node label, keys sorted
+func nodeLabelOf(nodeSelector map[string]string) string {
+	pairs := make([]string, 0, len(nodeSelector))
+	for key, value := range nodeSelector {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Compares node labels regardless of the order of their dimensions
+func sameNodeLabel(a string, b string) bool {
+	return nodeLabelOf(placement.NodeSelectorOf(a)) == nodeLabelOf(placement.NodeSelectorOf(b))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Shadow decisions kept per owner, older ones are dropped first
+const maxShadowDecisionsPerOwner = 10000
+
+// Node labels chosen by the shadow decisions of each owner, oldest first. Pods admitted in
+// shadow mode are left unpatched, so their placement is only known from these decisions:
+// the live pods of an owner are attributed, newest first, to its most recent decisions.
+// The ledger is held in memory by each webhook replica and starts empty after a restart.
+type ShadowLedger struct {
+	sync.Mutex
+	labels map[string][]string
+}
+
+var shadowDecisions = &ShadowLedger{labels: map[string][]string{}}
+
+// Owners placed together share their shadow decisions, as they share their pod counts
+func shadowOwnerKey(decision *PlacementDecision) string {
+	if decision.Group != "" {
+		return decision.Namespace + "/group/" + decision.Group
+	}
+	return decision.Namespace + "/" + decision.OwnerKind + "/" + decision.Owner
+}
+
+// Adds the node label chosen by a shadow decision
+func (l *ShadowLedger) Record(decision *PlacementDecision) {
+	if !decision.Shadow || decision.Outcome != decisionOutcomePlaced || decision.ChosenLabel == "" {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	key := shadowOwnerKey(decision)
+	labels := append(l.labels[key], decision.ChosenLabel)
+	if len(labels) > maxShadowDecisionsPerOwner {
+		labels = labels[len(labels)-maxShadowDecisionsPerOwner:]
+	}
+	l.labels[key] = labels
+}
+
+// Returns the pods attributed to shadow decisions that chose nodeLabel. Pods beyond the
+// recorded decisions, e.g. admitted before a restart, are attributed to no node label.
+func (l *ShadowLedger) PodsOn(decision *PlacementDecision, pods []corev1.Pod, nodeLabel string) []corev1.Pod {
+	l.Lock()
+	labels := l.labels[shadowOwnerKey(decision)]
+	l.Unlock()
+
+	ordered := make([]corev1.Pod, len(pods))
+	copy(ordered, pods)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].CreationTimestamp.Before(&ordered[j].CreationTimestamp)
+	})
+
+	onNodeLabel := []corev1.Pod{}
+	for i, j := len(ordered)-1, len(labels)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if sameNodeLabel(labels[j], nodeLabel) {
+			onNodeLabel = append(onNodeLabel, ordered[i])
+		}
+	}
+	return onNodeLabel
+}
+
+// Returns the live pods of the given owners attributed to shadow decisions that chose nodeLabel
+func GetShadowPods(ctx context.Context, decision *PlacementDecision, namespace string, ownerNames []string, nodeLabel string) ([]corev1.Pod, bool) {
+	ctx, span := tracer.Start(ctx, "CountShadowPods", trace.WithAttributes(attribute.String("placement.node_label", nodeLabel)))
+	defer span.End()
+
+	time.Sleep(podListDelay) // this is to give enough time for concurrent writes to etcd from other mutatting requests
+	pods, err := api.Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		loggerFrom(ctx).Error("failed to get pods", "error", err)
+		spanError(span, err)
+		return nil, false
+	}
+
+	owned := []corev1.Pod{}
+	for _, pod := range pods.Items {
+		if podBelongsToOwners(pod.Name, ownerNames) && pod.DeletionTimestamp == nil {
+			owned = append(owned, pod)
+		}
+	}
+	return shadowDecisions.PodsOn(decision, owned, nodeLabel), true
+}
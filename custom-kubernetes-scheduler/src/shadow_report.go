@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/jalawala/custom-kubernetes-scheduler/tree/main/admissionwebhook/pkg/placement"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// Shadow decisions of one owner compared with where its pods run
+type ShadowComparison struct {
+	Namespace string         `json:"namespace"`
+	OwnerKind string         `json:"ownerKind,omitempty"`
+	Owner     string         `json:"owner"`
+	Group     string         `json:"group,omitempty"`
+	Strategy  string         `json:"strategy"`
+	Targets   []ShadowTarget `json:"targets"`
+	Pending   int            `json:"pending"` // pods not bound to a node yet
+}
+
+type ShadowTarget struct {
+	NodeLabel string `json:"nodeLabel"`
+	Desired   int    `json:"desired"` // spread of the strategy and replicas of the latest shadow decision
+	Shadow    int    `json:"shadow"`  // shadow decisions that chose the node label
+	Actual    int    `json:"actual"`  // pods running on nodes carrying the node label
+}
+
+type ShadowReport struct {
+	Owners    []ShadowComparison `json:"owners"`
+	Decisions int                `json:"decisions"`
+	Diverging int                `json:"diverging"` // node labels whose actual pods differ from the desired ones
+}
+
+// Entry point of "custom-kube-scheduler-webhook shadow-report". Reads the shadow decisions
+// of an audit log and compares them with the node labels of the nodes the owners' pods were
+// bound to, using the current kubeconfig context or the in-cluster configuration.
+func RunShadowReport(args []string) int {
+	flags := flag.NewFlagSet("shadow-report", flag.ExitOnError)
+	auditFile := flags.String("audit", "", "Audit log (JSON lines of placement decisions) holding the shadow decisions.")
+	kubeconfig := flags.String("kubeconfig", os.Getenv("KUBECONFIG"), "Kubeconfig of the cluster, empty for the in-cluster configuration.")
+	output := flags.String("o", "text", "Report format, text or json.")
+	flags.Parse(args)
+
+	logger = NewLogger("WARN", "text")
+
+	if *auditFile == "" {
+		fmt.Fprintln(os.Stderr, "-audit is required")
+		return 2
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	clientset = client
+	api = client.CoreV1()
+
+	report, err := CompareShadowDecisions(context.Background(), *auditFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		report.Print(os.Stdout)
+	}
+	return 0
+}
+
+// Aggregates the shadow decisions of an audit log per owner and counts the owners' running
+// pods on each node label of the strategy of their latest decision
+func CompareShadowDecisions(ctx context.Context, auditFile string) (*ShadowReport, error) {
+	f, err := os.Open(auditFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	report := &ShadowReport{}
+	latest := map[string]*PlacementDecision{}
+	chosen := map[string]map[string]int{}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		decision := &PlacementDecision{}
+		if err := json.Unmarshal(scanner.Bytes(), decision); err != nil {
+			return nil, fmt.Errorf("invalid audit record: %v", err)
+		}
+		if !decision.Shadow || decision.Owner == "" || decision.Outcome == decisionOutcomeError {
+			continue
+		}
+		report.Decisions++
+
+		key := decision.Namespace + "/" + decision.Owner
+		latest[key] = decision
+		if chosen[key] == nil {
+			chosen[key] = map[string]int{}
+		}
+		if decision.ChosenLabel != "" {
+			chosen[key][decision.ChosenLabel]++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %v", err)
+	}
+	nodeLabels := map[string]map[string]string{}
+	for _, node := range nodes.Items {
+		nodeLabels[node.Name] = node.Labels
+	}
+
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	podsByNamespace := map[string][]corev1.Pod{}
+	for _, key := range keys {
+		decision := latest[key]
+		pods, ok := podsByNamespace[decision.Namespace]
+		if !ok {
+			podList, err := api.Pods(decision.Namespace).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to list pods of namespace %s: %v", decision.Namespace, err)
+			}
+			pods = podList.Items
+			podsByNamespace[decision.Namespace] = pods
+		}
+
+		comparison := ShadowComparison{
+			Namespace: decision.Namespace,
+			OwnerKind: decision.OwnerKind,
+			Owner:     decision.Owner,
+			Group:     decision.Group,
+			Strategy:  decision.Strategy,
+		}
+		nodeLabelStrategyList, err := placement.Distribute(logger, decision.Strategy, decision.Replicas)
+		if err != nil {
+			return nil, fmt.Errorf("invalid strategy of %s: %v", key, err)
+		}
+		for _, nodeLabelStrategy := range nodeLabelStrategyList {
+			comparison.Targets = append(comparison.Targets, ShadowTarget{NodeLabel: nodeLabelStrategy.NodeLabel, Desired: nodeLabelStrategy.Replicas, Shadow: chosen[key][nodeLabelStrategy.NodeLabel]})
+		}
+
+		for _, pod := range pods {
+			if !shadowDecisionOwns(decision, &pod) || pod.DeletionTimestamp != nil {
+				continue
+			}
+			if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+				continue
+			}
+			if pod.Spec.NodeName == "" {
+				comparison.Pending++
+				continue
+			}
+			for i := range comparison.Targets {
+				if placement.MatchesNodeLabel(nodeLabels[pod.Spec.NodeName], comparison.Targets[i].NodeLabel) {
+					comparison.Targets[i].Actual++
+				}
+			}
+		}
+
+		for _, target := range comparison.Targets {
+			if target.Actual != target.Desired {
+				report.Diverging++
+			}
+		}
+		report.Owners = append(report.Owners, comparison)
+	}
+	return report, nil
+}
+
+// Reports whether a pod belongs to the owner of a decision, matched the way the webhook
+// counts the owner's pods
+func shadowDecisionOwns(decision *PlacementDecision, pod *corev1.Pod) bool {
+	switch {
+	case decision.OwnerKind == "Deployment":
+		members := decision.GroupMembers
+		if len(members) == 0 {
+			members = []string{decision.Owner}
+		}
+		return podBelongsToOwners(pod.Name, members)
+	case decision.Group != "":
+		return pod.Annotations[customPodScheduleGroupKey] == decision.Group
+	case decision.OwnerKind != "":
+		controller := metav1.GetControllerOf(pod)
+		return controller != nil && controller.Kind == decision.OwnerKind && controller.Name == decision.Owner
+	}
+	return pod.Name == decision.Owner
+}
+
+// Prints the desired, shadow-chosen and actual pods per node label as a table
+func (report *ShadowReport) Print(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tOWNER\tNODE LABEL\tDESIRED\tSHADOW\tACTUAL\t")
+	for _, comparison := range report.Owners {
+		for _, target := range comparison.Targets {
+			diverging := ""
+			if target.Actual != target.Desired {
+				diverging = "DIVERGING"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%s\n", comparison.Namespace, comparison.Owner, target.NodeLabel, target.Desired, target.Shadow, target.Actual, diverging)
+		}
+		if comparison.Pending > 0 {
+			fmt.Fprintf(w, "%s\t%s\t%s\t\t\t%d\t\n", comparison.Namespace, comparison.Owner, "<pending>", comparison.Pending)
+		}
+	}
+	fmt.Fprintf(w, "\n%d shadow decisions, %d owners, %d node labels diverging\n", report.Decisions, len(report.Owners), report.Diverging)
+	w.Flush()
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/jalawala/custom-kubernetes-scheduler/tree/main/admissionwebhook/pkg/placement"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	appsv1 "k8s.io/api/apps/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Annotations and labels used by the splitter
+const (
+	// "mutate" (default) places the owner's pods at admission, "split" materialises one child
+	// Deployment per node label of the strategy
+	customPodScheduleModeKey = "custom-pod-schedule-mode"
+
+	// total replicas of a split parent, whose own replicas are kept at zero
+	customPodScheduleSplitReplicasKey = "custom-pod-schedule-split-replicas"
+
+	// set on child Deployments
+	customPodScheduleSplitParentKey         = "custom-pod-schedule-split-parent"
+	customPodScheduleSplitTargetKey         = "custom-pod-schedule-split-target"
+	customPodScheduleSplitParentReplicasKey = "custom-pod-schedule-split-parent-replicas"
+	customPodScheduleSplitTemplateHashKey   = "custom-pod-schedule-split-template-hash"
+	customPodScheduleSplitStrategyHashKey   = "custom-pod-schedule-split-strategy-hash"
+)
+
+// Scheduling modes accepted by the custom-pod-schedule-mode annotation
+const (
+	scheduleModeMutate = "mutate"
+	scheduleModeSplit  = "split"
+)
+
+var invalidNameCharacters = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// Periodically splits Deployments annotated with custom-pod-schedule-mode=split into one
+// child Deployment per node label of their strategy. Each child carries the node label as
+// node selector and the label's share of the parent's replicas, so it can have its own HPA,
+// PodDisruptionBudget and rollout status, and its pods need no mutation at admission.
+type Splitter struct {
+	period time.Duration
+}
+
+// Reads the splitter settings. SPLITTER_PERIOD is either a Go duration or a number of
+// minutes; zero or empty disables the splitter.
+func NewSplitterFromEnv() (*Splitter, error) {
+	period, err := durationFromEnv("SPLITTER_PERIOD")
+	if err != nil {
+		return nil, err
+	}
+	return &Splitter{period: period}, nil
+}
+
+// Reports whether the splitter is enabled
+func (s *Splitter) Enabled() bool {
+	return s.period > 0
+}
+
+// Syncs the split Deployments every period until ctx is cancelled
+func (s *Splitter) Run(ctx context.Context) {
+	logger.Info("starting splitter", "period", s.period)
+
+	ticker := time.NewTicker(s.period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sync(ctx)
+		}
+	}
+}
+
+// Single pass over every split parent in the namespaces the webhook serves
+func (s *Splitter) sync(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "Split")
+	defer span.End()
+
+	log := logger.With("flow", "SPLIT")
+	ctx = withLogger(ctx, log)
+
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: webhookNamespaceSelector})
+	if err != nil {
+		log.Error("failed to list namespaces", "error", err)
+		spanError(span, err)
+		return
+	}
+
+	for _, namespace := range namespaces.Items {
+		if !mutationRequired(ignoredNamespaces, &namespace.ObjectMeta) {
+			continue
+		}
+
+		deployments, err := clientset.AppsV1().Deployments(namespace.Name).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			log.Error("failed to list deployments", "namespace", namespace.Name, "error", err)
+			continue
+		}
+
+		children := map[types.UID][]*appsv1.Deployment{}
+		for i := range deployments.Items {
+			deployment := &deployments.Items[i]
+			if owner := metav1.GetControllerOf(deployment); owner != nil && deployment.Annotations[customPodScheduleSplitParentKey] != "" {
+				children[owner.UID] = append(children[owner.UID], deployment)
+			}
+		}
+
+		for i := range deployments.Items {
+			parent := &deployments.Items[i]
+			if parent.Annotations[customPodScheduleModeKey] != scheduleModeSplit || parent.DeletionTimestamp != nil {
+				continue
+			}
+			if err := s.syncParent(ctx, parent, children[parent.UID]); err != nil {
+				log.Error("failed to split deployment", "namespace", parent.Namespace, "owner", parent.Name, "error", err)
+			}
+		}
+	}
+}
+
+// Brings the children of one split parent in line with its strategy, replicas and pod template
+func (s *Splitter) syncParent(ctx context.Context, parent *appsv1.Deployment, children []*appsv1.Deployment) error {
+	ctx, span := tracer.Start(ctx, "SplitDeployment", trace.WithAttributes(
+		attribute.String("k8s.namespace.name", parent.Namespace),
+		attribute.String("placement.owner", parent.Name),
+	))
+	defer span.End()
+
+	log := loggerFrom(ctx).With("namespace", parent.Namespace, "owner", parent.Name)
+	ctx = withLogger(ctx, log)
+
+	if parent.Annotations[customPodScheduleGroupKey] != "" {
+		log.Warn("quota groups do not apply to split deployments, splitting the deployment on its own")
+	}
+
+	resolvedStrategy, err := ResolveStrategy(ctx, parent.Namespace, parent.Annotations)
+	if err != nil {
+		spanError(span, err)
+		return err
+	}
+	if resolvedStrategy == nil {
+		log.Warn("deployment asks to be split but has no strategy")
+		return nil
+	}
+
+	replicas, err := s.takeParentReplicas(ctx, parent)
+	if err != nil {
+		spanError(span, err)
+		return err
+	}
+
+	strategy := resolvedStrategy.Strategy
+	if placement.UsesCostWeights(strategy) {
+		weightedStrategy, costErr := CostWeightedStrategy(ctx, strategy)
+		if costErr != nil {
+			spanError(span, costErr)
+			return costErr
+		}
+		log.Info("derived cost-weighted strategy from the price table", "template", strategy, "strategy", weightedStrategy)
+		strategy = weightedStrategy
+	}
+
+	nodeLabelStrategyList, ok := GetPodsCustomSchedulingStrategyList(ctx, strategy, replicas)
+	if !ok {
+		err = fmt.Errorf("invalid strategy %q", strategy)
+		spanError(span, err)
+		return err
+	}
+
+	existing := map[string]*appsv1.Deployment{}
+	for _, child := range children {
+		existing[child.Name] = child
+	}
+
+	for _, nodeLabelStrategy := range nodeLabelStrategyList {
+		desired, err := splitChild(parent, nodeLabelStrategy, replicas, strategy)
+		if err != nil {
+			spanError(span, err)
+			return err
+		}
+
+		current := existing[desired.Name]
+		delete(existing, desired.Name)
+
+		if err := s.applyChild(ctx, current, desired); err != nil {
+			spanError(span, err)
+			return err
+		}
+	}
+
+	// node labels that left the strategy
+	for _, child := range existing {
+		log.Info("deleting child deployment of a removed node label", "child", child.Name, "nodeLabel", child.Annotations[customPodScheduleSplitTargetKey])
+		if err := clientset.AppsV1().Deployments(child.Namespace).Delete(ctx, child.Name, metav1.DeleteOptions{}); err != nil {
+			spanError(span, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the total replicas of a split parent. Replicas set on the parent itself (by a
+// kubectl scale or apply) become the new total, recorded in an annotation, and the parent is
+// scaled down to zero so that only the children run pods.
+func (s *Splitter) takeParentReplicas(ctx context.Context, parent *appsv1.Deployment) (int, error) {
+	replicas, _ := strconv.Atoi(parent.Annotations[customPodScheduleSplitReplicasKey])
+	if parent.Spec.Replicas == nil || *parent.Spec.Replicas == 0 {
+		return replicas, nil
+	}
+
+	replicas = int(*parent.Spec.Replicas)
+	loggerFrom(ctx).Info("taking over the replicas of the split deployment", "replicas", replicas)
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{customPodScheduleSplitReplicasKey: strconv.Itoa(replicas)},
+		},
+		"spec": map[string]interface{}{"replicas": 0},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = clientset.AppsV1().Deployments(parent.Namespace).Patch(ctx, parent.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return replicas, err
+}
+
+// Builds the child Deployment of a split parent for one node label
+func splitChild(parent *appsv1.Deployment, nodeLabelStrategy NodeLabelStrategy, parentReplicas int, strategy string) (*appsv1.Deployment, error) {
+	nodeSelector := placement.NodeSelectorOf(nodeLabelStrategy.NodeLabel)
+	if len(nodeSelector) == 0 {
+		return nil, fmt.Errorf("invalid node label %q", nodeLabelStrategy.NodeLabel)
+	}
+
+	// named after the label values of every dimension, e.g. web-spot-us-west-2a
+	values := []string{}
+	for _, pair := range strings.Split(nodeLabelStrategy.NodeLabel, ",") {
+		_, value, _ := strings.Cut(pair, "=")
+		values = append(values, strings.ToLower(value))
+	}
+	target := strings.Trim(invalidNameCharacters.ReplaceAllString(strings.Join(values, "-"), "-"), "-")
+	if target == "" || len(target) > 63 {
+		target = fmt.Sprintf("%x", sha256.Sum256([]byte(nodeLabelStrategy.NodeLabel)))[:10]
+	}
+
+	child := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      parent.Name + "-" + target,
+			Namespace: parent.Namespace,
+			Labels:    map[string]string{},
+			Annotations: map[string]string{
+				customPodScheduleSplitParentKey:         parent.Name,
+				customPodScheduleSplitTargetKey:         nodeLabelStrategy.NodeLabel,
+				customPodScheduleSplitParentReplicasKey: strconv.Itoa(parentReplicas),
+				customPodScheduleSplitStrategyHashKey:   fmt.Sprintf("%x", sha256.Sum256([]byte(strategy)))[:16],
+			},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(parent, appsv1.SchemeGroupVersion.WithKind("Deployment"))},
+		},
+		Spec: *parent.Spec.DeepCopy(),
+	}
+	for key, value := range parent.Labels {
+		child.Labels[key] = value
+	}
+	child.Labels[customPodScheduleSplitTargetKey] = target
+
+	replicas := int32(nodeLabelStrategy.Replicas)
+	child.Spec.Replicas = &replicas
+
+	// the target label keeps the children's selectors apart from each other
+	if child.Spec.Selector == nil {
+		child.Spec.Selector = &metav1.LabelSelector{}
+	}
+	if child.Spec.Selector.MatchLabels == nil {
+		child.Spec.Selector.MatchLabels = map[string]string{}
+	}
+	child.Spec.Selector.MatchLabels[customPodScheduleSplitTargetKey] = target
+
+	if child.Spec.Template.Labels == nil {
+		child.Spec.Template.Labels = map[string]string{}
+	}
+	child.Spec.Template.Labels[customPodScheduleSplitTargetKey] = target
+
+	if child.Spec.Template.Spec.NodeSelector == nil {
+		child.Spec.Template.Spec.NodeSelector = map[string]string{}
+	}
+	for key, value := range nodeSelector {
+		child.Spec.Template.Spec.NodeSelector[key] = value
+	}
+
+	template, err := json.Marshal(child.Spec.Template)
+	if err != nil {
+		return nil, err
+	}
+	child.Annotations[customPodScheduleSplitTemplateHashKey] = fmt.Sprintf("%x", sha256.Sum256(template))[:16]
+
+	return child, nil
+}
+
+// Creates or updates a child Deployment. The child's replicas are only reset when the
+// parent's total or the strategy changes, so a per-pool HPA may scale the child in between.
+func (s *Splitter) applyChild(ctx context.Context, current *appsv1.Deployment, desired *appsv1.Deployment) error {
+	log := loggerFrom(ctx).With("child", desired.Name, "nodeLabel", desired.Annotations[customPodScheduleSplitTargetKey])
+	deploymentsClient := clientset.AppsV1().Deployments(desired.Namespace)
+
+	if current == nil {
+		log.Info("creating child deployment", "replicas", *desired.Spec.Replicas)
+		_, err := deploymentsClient.Create(ctx, desired, metav1.CreateOptions{})
+		return err
+	}
+
+	// the selector of a Deployment is immutable, the child is recreated on the next sync
+	if !apiequality.Semantic.DeepEqual(current.Spec.Selector, desired.Spec.Selector) {
+		log.Info("selector of the parent changed, deleting child deployment")
+		return deploymentsClient.Delete(ctx, current.Name, metav1.DeleteOptions{})
+	}
+
+	replicasChanged := current.Annotations[customPodScheduleSplitParentReplicasKey] != desired.Annotations[customPodScheduleSplitParentReplicasKey] ||
+		current.Annotations[customPodScheduleSplitStrategyHashKey] != desired.Annotations[customPodScheduleSplitStrategyHashKey]
+	templateChanged := current.Annotations[customPodScheduleSplitTemplateHashKey] != desired.Annotations[customPodScheduleSplitTemplateHashKey]
+	if !replicasChanged && !templateChanged {
+		return nil
+	}
+
+	updated := current.DeepCopy()
+	updated.Labels = desired.Labels
+	for key, value := range desired.Annotations {
+		if updated.Annotations == nil {
+			updated.Annotations = map[string]string{}
+		}
+		updated.Annotations[key] = value
+	}
+	updated.Spec.Template = desired.Spec.Template
+	updated.Spec.Strategy = desired.Spec.Strategy
+	updated.Spec.MinReadySeconds = desired.Spec.MinReadySeconds
+	updated.Spec.RevisionHistoryLimit = desired.Spec.RevisionHistoryLimit
+	updated.Spec.ProgressDeadlineSeconds = desired.Spec.ProgressDeadlineSeconds
+	if replicasChanged {
+		updated.Spec.Replicas = desired.Spec.Replicas
+	}
+
+	log.Info("updating child deployment", "replicasChanged", replicasChanged, "templateChanged", templateChanged, "replicas", *updated.Spec.Replicas)
+	_, err := deploymentsClient.Update(ctx, updated, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"reflect"
+	"time"
+)
+
+const customPodScheduleStatusKey = "custom-pod-schedule-status"
+
+// Phases reported in the custom-pod-schedule-status annotation
+const (
+	scheduleStatusSettled   = "Settled"   // every node label runs its desired number of pods
+	scheduleStatusDrifted   = "Drifted"   // pods are misplaced under an unchanged strategy
+	scheduleStatusMigrating = "Migrating" // the strategy changed and pods are being moved towards it
+)
+
+// Placement state of a strategy-managed owner, stored as JSON in its
+// custom-pod-schedule-status annotation
+type ScheduleStatus struct {
+	Strategy           string              `json:"strategy"`
+	PreviousStrategy   string              `json:"previousStrategy,omitempty"`
+	Phase              string              `json:"phase"`
+	Targets            []TargetObservation `json:"targets,omitempty"`
+	MisplacedPods      int                 `json:"misplacedPods"`
+	MigratedPods       int                 `json:"migratedPods,omitempty"`
+	ExpectedHourlyCost float64             `json:"expectedHourlyCost,omitempty"` // when a price table prices the spread
+	LastUpdateTime     time.Time           `json:"lastUpdateTime"`
+}
+
+// Returns the status recorded on a Deployment, or nil if there is none or it cannot be read
+func GetScheduleStatus(deployment *appsv1.Deployment) *ScheduleStatus {
+	value := deployment.Annotations[customPodScheduleStatusKey]
+	if value == "" {
+		return nil
+	}
+
+	status := &ScheduleStatus{}
+	if err := json.Unmarshal([]byte(value), status); err != nil {
+		logger.Warn("ignoring unreadable schedule status", "namespace", deployment.Namespace, "owner", deployment.Name, "error", err)
+		return nil
+	}
+	return status
+}
+
+// Reports whether two statuses differ in anything but their update time
+func (s *ScheduleStatus) changedFrom(previous *ScheduleStatus) bool {
+	if previous == nil {
+		return true
+	}
+	current, last := *s, *previous
+	current.LastUpdateTime, last.LastUpdateTime = time.Time{}, time.Time{}
+	return !reflect.DeepEqual(current, last)
+}
+
+// Writes the status annotation on a Deployment with a merge patch
+func UpdateScheduleStatus(ctx context.Context, namespace string, deploymentName string, status *ScheduleStatus) error {
+	value, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{customPodScheduleStatusKey: string(value)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = clientset.AppsV1().Deployments(namespace).Patch(ctx, deploymentName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+)
+
+// Strategy sources recorded with a resolved strategy
+const (
+	strategySourceOwner     = "owner"
+	strategySourceNamespace = "namespace"
+)
+
+// A strategy chosen for an owner together with where it came from
+type ResolvedStrategy struct {
+	Strategy     string
+	CountingMode string
+	Source       string // owner, namespace, owner-template:<name> or namespace-template:<name>
+	Shadow       bool   // the decision is only recorded, the pod is not patched
+}
+
+// Resolves the strategy that applies to an owner. An inline custom-pod-schedule-strategy
+// annotation on the owner wins, then a custom-pod-schedule-strategy-template reference on
+// the owner, then the same two annotations on the owner's namespace. The counting mode and
+// the custom-pod-schedule-shadow flag are taken from the owner if set there, otherwise from
+// the namespace. Returns nil when no strategy applies.
+func ResolveStrategy(ctx context.Context, namespace string, ownerAnnotations map[string]string) (*ResolvedStrategy, error) {
+	ctx, span := tracer.Start(ctx, "ResolveStrategy")
+	defer span.End()
+
+	resolved, err := strategyFromAnnotations(ctx, ownerAnnotations, strategySourceOwner)
+	if err != nil {
+		spanError(span, err)
+		return nil, err
+	}
+	if resolved != nil && ownerAnnotations[customPodScheduleCountingModeKey] != "" && ownerAnnotations[customPodScheduleShadowKey] != "" {
+		resolved.CountingMode = ownerAnnotations[customPodScheduleCountingModeKey]
+		resolved.Shadow = ownerAnnotations[customPodScheduleShadowKey] == "true"
+		return resolved, nil
+	}
+
+	namespaceData, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		err = fmt.Errorf("failed to get namespace %s: %v", namespace, err)
+		spanError(span, err)
+		return nil, err
+	}
+
+	if resolved == nil {
+		resolved, err = strategyFromAnnotations(ctx, namespaceData.Annotations, strategySourceNamespace)
+		if err != nil {
+			spanError(span, err)
+			return nil, err
+		}
+		if resolved == nil {
+			return nil, nil
+		}
+	}
+
+	resolved.CountingMode = ownerAnnotations[customPodScheduleCountingModeKey]
+	if resolved.CountingMode == "" {
+		resolved.CountingMode = namespaceData.Annotations[customPodScheduleCountingModeKey]
+	}
+	shadow := ownerAnnotations[customPodScheduleShadowKey]
+	if shadow == "" {
+		shadow = namespaceData.Annotations[customPodScheduleShadowKey]
+	}
+	resolved.Shadow = shadow == "true"
+	return resolved, nil
+}
+
+func strategyFromAnnotations(ctx context.Context, annotations map[string]string, source string) (*ResolvedStrategy, error) {
+	if strategy := annotations[customPodScheduleStrategyKey]; strategy != "" {
+		return &ResolvedStrategy{Strategy: strategy, Source: source}, nil
+	}
+
+	if templateName := annotations[customPodScheduleStrategyTemplateKey]; templateName != "" {
+		strategy, err := GetStrategyTemplate(ctx, templateName)
+		if err != nil {
+			return nil, err
+		}
+		return &ResolvedStrategy{Strategy: strategy, Source: source + "-template:" + templateName}, nil
+	}
+
+	return nil, nil
+}
+
+// Looks up a named strategy template in the ConfigMap given by StrategyTemplatesConfigMap
+// ("namespace/name"). Each key of the ConfigMap data is a template name and its value a
+// strategy in the usual custom-pod-schedule-strategy syntax.
+func GetStrategyTemplate(ctx context.Context, templateName string) (string, error) {
+	configMapNamespace, configMapName, ok := strings.Cut(StrategyTemplatesConfigMap, "/")
+	if !ok || configMapNamespace == "" || configMapName == "" {
+		return "", fmt.Errorf("strategy template %s referenced but STRATEGY_TEMPLATES_CONFIGMAP=%q is not of the form namespace/name", templateName, StrategyTemplatesConfigMap)
+	}
+
+	configMap, err := clientset.CoreV1().ConfigMaps(configMapNamespace).Get(ctx, configMapName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get strategy templates ConfigMap %s: %v", StrategyTemplatesConfigMap, err)
+	}
+
+	strategy := strings.TrimSpace(configMap.Data[templateName])
+	if strategy == "" {
+		return "", fmt.Errorf("strategy template %s not found in ConfigMap %s", templateName, StrategyTemplatesConfigMap)
+	}
+
+	loggerFrom(ctx).Debug("resolved strategy template", "template", templateName, "strategy", strategy)
+	return strategy, nil
+}
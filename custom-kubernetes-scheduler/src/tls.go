@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Builds the TLS configuration of the webhook listener from the -tls* flags. When a client
+// CA is given, the API server must present a certificate it signed, e.g. the front-proxy
+// client certificate, and its common name must be one of the allowed client names if set.
+func NewTLSConfig(parameters WhSvrParameters, pair tls.Certificate) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[parameters.tlsMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid -tlsMinVersion %q, allowed values are 1.2 and 1.3", parameters.tlsMinVersion)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   minVersion,
+	}
+
+	if parameters.tlsCipherSuites != "" {
+		cipherSuites, err := parseCipherSuites(parameters.tlsCipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		// TLS 1.3 suites are not configurable, the list only applies to TLS 1.2 handshakes
+		config.CipherSuites = cipherSuites
+	}
+
+	if !parameters.enableHTTP2 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+
+	if parameters.tlsClientCAFile != "" {
+		caData, err := ioutil.ReadFile(parameters.tlsClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %v", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificate found in client CA %s", parameters.tlsClientCAFile)
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+
+		if allowedNames := splitList(parameters.tlsClientNames); len(allowedNames) > 0 {
+			config.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+				for _, chain := range verifiedChains {
+					for _, name := range allowedNames {
+						if chain[0].Subject.CommonName == name {
+							return nil
+						}
+					}
+				}
+				return errors.New("client certificate common name is not allowed")
+			}
+		}
+	} else if parameters.tlsClientNames != "" {
+		return nil, errors.New("-tlsClientNames requires -tlsClientCAFile")
+	}
+
+	return config, nil
+}
+
+// Parses a comma-separated list of IANA cipher suite names, refusing the insecure ones
+func parseCipherSuites(names string) ([]uint16, error) {
+	secure := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+	insecure := map[string]bool{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	cipherSuites := []uint16{}
+	for _, name := range splitList(names) {
+		if insecure[name] {
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		cipherSuites = append(cipherSuites, id)
+	}
+	return cipherSuites, nil
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Creates the webhook listener with the hardened TLS configuration and timeouts. HTTP/2
+// is only offered with -enableHTTP2.
+func NewWebhookHTTPServer(parameters WhSvrParameters, tlsConfig *tls.Config) *http.Server {
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%v", parameters.port),
+		TLSConfig:         tlsConfig,
+		ReadTimeout:       parameters.readTimeout,
+		ReadHeaderTimeout: parameters.readTimeout,
+		WriteTimeout:      parameters.writeTimeout,
+		IdleTimeout:       parameters.idleTimeout,
+	}
+	if !parameters.enableHTTP2 {
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return server
+}
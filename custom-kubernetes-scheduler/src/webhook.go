@@ -4,9 +4,14 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ghodss/yaml"
-	"github.com/golang/glog"
+	"github.com/jalawala/custom-kubernetes-scheduler/tree/main/admissionwebhook/pkg/placement"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"io/ioutil"
 	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
@@ -14,11 +19,10 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
-	"log"
 	"net/http"
-	"os"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -33,12 +37,18 @@ var (
 	defaulter = runtime.ObjectDefaulter(runtimeScheme)
 )
 
+// Set by InitClientset in the cluster, or to a fake clientset by the replay command
 var (
-	config, err1    = rest.InClusterConfig()
-	clientset, err2 = kubernetes.NewForConfig(config)
-	api             = clientset.CoreV1()
+	clientset kubernetes.Interface
+	api       typedcorev1.CoreV1Interface
 )
 
+// Set by SHADOW_MODE=true: every decision is recorded but no pod is patched
+var shadowMode bool
+
+// Time given to concurrent admissions to write their pods to etcd before pods are counted
+var podListDelay = 500 * time.Millisecond
+
 var ignoredNamespaces = []string{
 	metav1.NamespaceSystem,
 	metav1.NamespacePublic,
@@ -48,11 +58,26 @@ var ignoredNamespaces = []string{
 const (
 	admissionWebhookAnnotationInjectKey = "sidecar-injector-webhook.morven.me/inject"
 	admissionWebhookAnnotationStatusKey = "sidecar-injector-webhook.morven.me/status"
+
+	customPodScheduleStrategyKey         = placement.StrategyKey
+	customPodScheduleStrategyTemplateKey = placement.StrategyTemplateKey
+	customPodScheduleCountingModeKey     = placement.CountingModeKey
+	customPodScheduleGroupKey            = placement.GroupKey
+	customPodScheduleShadowKey           = placement.ShadowKey
+)
+
+// Pod counting modes accepted by the custom-pod-schedule-counting-mode annotation
+const (
+	podCountingModeAll       = placement.CountingModeAll
+	podCountingModeScheduled = placement.CountingModeScheduled
+	podCountingModeReady     = placement.CountingModeReady
 )
 
 type WebhookServer struct {
 	sync.Mutex
-	server *http.Server
+	server              *http.Server
+	maxRequestBodyBytes int64           // larger AdmissionReviews are refused, 0 means no limit
+	admissions          *AdmissionCache // responses of recent admissions, nil disables caching
 }
 
 // Webhook Server parameters
@@ -61,6 +86,17 @@ type WhSvrParameters struct {
 	certFile       string // path to the x509 certificate for https
 	keyFile        string // path to the x509 private key matching `CertFile`
 	sidecarCfgFile string // path to sidecar injector configuration file
+	metricsPort    int    // plain http port serving /metrics, 0 disables it
+
+	tlsMinVersion       string        // minimum TLS version, 1.2 or 1.3
+	tlsCipherSuites     string        // comma-separated IANA names of the TLS 1.2 cipher suites, empty for Go's defaults
+	tlsClientCAFile     string        // path to the CA bundle verifying client certificates, empty disables client authentication
+	tlsClientNames      string        // comma-separated common names allowed for client certificates, empty allows any
+	enableHTTP2         bool          // offer HTTP/2 besides HTTP/1.1
+	maxRequestBodyBytes int64         // largest AdmissionReview accepted
+	readTimeout         time.Duration // time allowed to read a request
+	writeTimeout        time.Duration // time allowed to write a response
+	idleTimeout         time.Duration // time keep-alive connections stay open between requests
 }
 
 type Config struct {
@@ -74,22 +110,35 @@ type patchOperation struct {
 	Value interface{} `json:"value,omitempty"`
 }
 
-type NodeLabelStrategy struct {
-	NodeLabel string
-	Replicas  int
-	Weight    int
-}
+type NodeLabelStrategy = placement.NodeLabelStrategy
 
 var (
 	serviceInstance = 1
 )
 
+// Connects the clientset to the cluster the webhook runs in
+func InitClientset() (*rest.Config, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	clientset = client
+	api = client.CoreV1()
+	return config, nil
+}
+
 func loadConfig(configFile string) (*Config, error) {
 	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		return nil, err
 	}
-	glog.Infof("New configuration: sha256sum %x", sha256.Sum256(data))
+	logger.Info("new configuration", "sha256sum", fmt.Sprintf("%x", sha256.Sum256(data)))
 
 	var cfg Config
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
@@ -104,33 +153,39 @@ func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
 	// skip special kubernete system namespaces
 	for _, namespace := range BlockedNameSpaceList {
 		if metadata.Namespace == namespace {
-			glog.Infof("Skip mutation for %v for it's in special namespace:%v", metadata.Name, metadata.Namespace)
+			logger.Info("skip mutation for pod in blocklisted namespace", "pod", metadata.Name, "namespace", metadata.Namespace)
 			return false
 		}
 	}
 	return true
 }
 
+// Adds the node selectors in a single operation when the pod has none, otherwise one
+// operation per key, so that selectors for several dimensions all survive the patch
 func updateNodeSelectors(target map[string]string, added map[string]string, basePath string) (patch []patchOperation) {
-	for key, value := range added {
-		if target == nil || target[key] == "" {
-			target = map[string]string{}
-			patch = append(patch, patchOperation{
-				Op:   "add",
-				Path: basePath,
-				Value: map[string]string{
-					key: value,
-				},
-			})
-		} else {
-			patch = append(patch, patchOperation{
-				Op:   "add",
-				Path: basePath,
-				Value: map[string]string{
-					key: value,
-				},
-			})
-		}
+	if len(added) == 0 {
+		return patch
+	}
+	if len(target) == 0 {
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath,
+			Value: added,
+		})
+	}
+
+	keys := make([]string, 0, len(added))
+	for key := range added {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key),
+			Value: added[key],
+		})
 	}
 	return patch
 }
@@ -168,12 +223,27 @@ func createPatch(pod *corev1.Pod, nodeselectors map[string]string) ([]byte, erro
 }
 
 // main mutation process
-func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview, serviceInstanceNum int) *v1beta1.AdmissionResponse {
+func (whsvr *WebhookServer) mutate(ctx context.Context, ar *v1beta1.AdmissionReview, serviceInstanceNum int) *v1beta1.AdmissionResponse {
 	req := ar.Request
 
+	ctx, span := tracer.Start(ctx, "AdmissionReview", trace.WithAttributes(
+		attribute.String("admission.uid", string(req.UID)),
+		attribute.String("k8s.namespace.name", req.Namespace),
+		attribute.String("admission.operation", string(req.Operation)),
+	))
+	defer span.End()
+
+	log := logger.With("uid", req.UID, "namespace", req.Namespace, "serviceInstance", serviceInstanceNum)
+	traceID := traceIDFrom(ctx)
+	if traceID != "" {
+		log = log.With("traceId", traceID)
+	}
+	ctx = withLogger(ctx, log)
+
 	var pod corev1.Pod
 	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
-		glog.Errorf("Could not unmarshal raw object: %v", err)
+		log.Error("could not unmarshal raw object", "error", err)
+		spanError(span, err)
 		return &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
@@ -181,28 +251,81 @@ func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview, serviceInstanceN
 		}
 	}
 
-	glog.Infof("serviceInstanceNum=%d AdmissionReview for Kind=%v Name=%v Namespace=%v UID=%v patchOperation=%v",
-		serviceInstanceNum, req.Kind, req.Name, req.Namespace, req.UID, req.Operation)
+	log = log.With("pod", pod.GenerateName)
+	ctx = withLogger(ctx, log)
+	span.SetAttributes(attribute.String("k8s.pod.generate_name", pod.GenerateName))
+	log.Info("admission review", "kind", req.Kind.Kind, "name", req.Name, "operation", req.Operation)
+
+	// a retried request gets the response of the first attempt rather than being placed again
+	cacheKey := admissionCacheKey(req, &pod)
+	if response, ok := whsvr.admissions.Get(cacheKey); ok {
+		log.Info("replaying cached admission response", "patch", string(response.Patch))
+		span.SetAttributes(attribute.Bool("admission.cached", true))
+		admissionCacheHitsCounter.WithLabelValues(req.Namespace).Inc()
+		return response
+	}
+
+	decision := &PlacementDecision{
+		Time:            time.Now().UTC(),
+		UID:             string(req.UID),
+		TraceID:         traceID,
+		ServiceInstance: serviceInstanceNum,
+		Namespace:       req.Namespace,
+		Pod:             pod.GenerateName,
+	}
 
 	// determine whether to perform mutation
 	if !mutationRequired(ignoredNamespaces, &pod.ObjectMeta) {
-		glog.Infof("serviceInstanceNum=%d Skipping mutation for %s/%s due to policy check", serviceInstanceNum, pod.Namespace, pod.Name)
+		log.Info("skipping mutation due to policy check")
 		return &v1beta1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 
-	// Workaround: https://github.com/kubernetes/kubernetes/issues/57982
-	nodeselectors, ok := GetNodeLabel(req.Namespace, pod.GenerateName, pod.Labels["pod-template-hash"], serviceInstanceNum)
+	// pods of the secondary scheduler are placed by its plugin with node fit in view
+	if pod.Spec.SchedulerName == placement.SchedulerName {
+		log.Info("skipping mutation, pod is placed by the scheduler plugin", "schedulerName", pod.Spec.SchedulerName)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	var nodeselectors map[string]string
+	var ok bool
+	if podHasOwnStrategy(&pod) {
+		// bare pods and Job pods carry their strategy and group key on the pod itself
+		nodeselectors, ok = ProcessPod(ctx, decision, req.Namespace, &pod)
+	} else {
+		// Workaround: https://github.com/kubernetes/kubernetes/issues/57982
+		nodeselectors, ok = GetNodeLabel(ctx, decision, req.Namespace, pod.GenerateName, pod.Labels["pod-template-hash"])
+	}
+	span.SetAttributes(
+		attribute.String("placement.owner", decision.Owner),
+		attribute.String("placement.outcome", decision.Outcome),
+		attribute.String("placement.chosen_label", decision.ChosenLabel),
+	)
+	recordDecision(ctx, decision)
 	if !ok {
-		glog.Infof("serviceInstanceNum=%d Skipping mutation for %s/%s due to GetNodeLabel failure", serviceInstanceNum, pod.Namespace, pod.Name)
+		log.Info("skipping mutation due to GetNodeLabel failure")
 		return &v1beta1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 
+	if decision.Shadow {
+		log.Info("skipping mutation, shadow mode", "nodeSelector", nodeselectors)
+		response := &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+		whsvr.admissions.Put(cacheKey, response)
+		return response
+	}
+
+	_, patchSpan := tracer.Start(ctx, "CreatePatch")
 	patchBytes, err := createPatch(&pod, nodeselectors)
+	patchSpan.End()
 	if err != nil {
+		spanError(span, err)
 		return &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
@@ -210,8 +333,8 @@ func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview, serviceInstanceN
 		}
 	}
 
-	glog.Infof("serviceInstanceNum=%d AdmissionResponse: patch=%v\n", serviceInstanceNum, string(patchBytes))
-	return &v1beta1.AdmissionResponse{
+	log.Info("admission response", "patch", string(patchBytes))
+	response := &v1beta1.AdmissionResponse{
 		Allowed: true,
 		Patch:   patchBytes,
 		PatchType: func() *v1beta1.PatchType {
@@ -219,12 +342,14 @@ func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview, serviceInstanceN
 			return &pt
 		}(),
 	}
+	whsvr.admissions.Put(cacheKey, response)
+	return response
 }
 
 // Serve method for webhook server
 func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 
-	glog.Infof("serve: serviceInstance=%d", serviceInstance)
+	logger.Debug("serve", "serviceInstance", serviceInstance)
 
 	whsvr.Lock()
 	defer whsvr.Unlock()
@@ -234,13 +359,23 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 
 	var body []byte
 	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
+		if whsvr.maxRequestBodyBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, whsvr.maxRequestBodyBytes)
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			logger.Error("request body too large", "limit", maxBytesErr.Limit)
+			http.Error(w, fmt.Sprintf("request body larger than %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err == nil {
 			body = data
 		}
 	}
 
 	if len(body) == 0 {
-		glog.Error("empty body")
+		logger.Error("empty body")
 		http.Error(w, "empty body", http.StatusBadRequest)
 		return
 	}
@@ -248,7 +383,7 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 	// verify the content type is accurate
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
-		glog.Errorf("Content-Type=%s, expect application/json", contentType)
+		logger.Error("invalid Content-Type, expect application/json", "contentType", contentType)
 		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
 		return
 	}
@@ -256,14 +391,15 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 	var admissionResponse *v1beta1.AdmissionResponse
 	ar := v1beta1.AdmissionReview{}
 	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		glog.Errorf("Can't decode body: %v", err)
+		logger.Error("can't decode body", "error", err)
 		admissionResponse = &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
 		}
 	} else {
-		admissionResponse = whsvr.mutate(&ar, serviceInstanceNum)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		admissionResponse = whsvr.mutate(ctx, &ar, serviceInstanceNum)
 	}
 
 	admissionReview := v1beta1.AdmissionReview{}
@@ -276,45 +412,35 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := json.Marshal(admissionReview)
 	if err != nil {
-		glog.Errorf("Can't encode response: %v", err)
+		logger.Error("can't encode response", "error", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
 	}
 
-	glog.Infof("Ready to write reponse ...")
+	logger.Debug("ready to write response", "serviceInstance", serviceInstanceNum)
 	if _, err := w.Write(resp); err != nil {
-		glog.Errorf("Can't write response: %v", err)
+		logger.Error("can't write response", "error", err)
 		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
 	}
 
 }
 
-func GetNodeLabel(nameSpace string, podGenerateName string, podTemplateHash string, serviceInstanceNum int) (map[string]string, bool) {
-
-	if err1 != nil {
-		panic(err1.Error())
-	}
-	if err2 != nil {
-		panic(err2.Error())
-	}
+func GetNodeLabel(ctx context.Context, decision *PlacementDecision, nameSpace string, podGenerateName string, podTemplateHash string) (map[string]string, bool) {
 
 	result := false
 	nodeselectors := make(map[string]string)
 
-	if AppLogLevel == "INFO" {
-		glog.Infof("serviceInstanceNum=%d GetNodeLabel  nameSpace=%v podGenerateName=%v podTemplateHash=%v", serviceInstanceNum, nameSpace, podGenerateName, podTemplateHash)
-	}
+	loggerFrom(ctx).Debug("GetNodeLabel", "podGenerateName", podGenerateName, "podTemplateHash", podTemplateHash)
 
 	podNameSplitList := strings.Split(podGenerateName, podTemplateHash)
-	fmt.Println("")
 	deploymentName := strings.Trim(podNameSplitList[0], "-")
 
-	nodeselectors, result = ProcessDeployment(nameSpace, deploymentName, serviceInstanceNum, "CREATE")
+	nodeselectors, result = ProcessDeployment(ctx, decision, nameSpace, deploymentName, "CREATE")
 
 	return nodeselectors, result
 
 }
 
-func ProcessDeployment(nameSpace string, deploymentName string, serviceInstanceNum int, flow string) (map[string]string, bool) {
+func ProcessDeployment(ctx context.Context, decision *PlacementDecision, nameSpace string, deploymentName string, flow string) (map[string]string, bool) {
 
 	var numOfReplicas int
 
@@ -322,280 +448,232 @@ func ProcessDeployment(nameSpace string, deploymentName string, serviceInstanceN
 	nodeselectors := make(map[string]string)
 	deploymentAnnotations := map[string]string{}
 
+	log := loggerFrom(ctx).With("flow", flow, "owner", deploymentName)
+	ctx = withLogger(ctx, log)
+	decision.OwnerKind, decision.Owner = "Deployment", deploymentName
+
+	ownerCtx, ownerSpan := tracer.Start(ctx, "GetOwner", trace.WithAttributes(attribute.String("placement.owner", deploymentName)))
 	deploymentsClient := clientset.AppsV1().Deployments(nameSpace)
-	deploymentData, getErr := deploymentsClient.Get(context.TODO(), deploymentName, metav1.GetOptions{})
+	deploymentData, getErr := deploymentsClient.Get(ownerCtx, deploymentName, metav1.GetOptions{})
+	if getErr != nil {
+		spanError(ownerSpan, getErr)
+	}
+	ownerSpan.End()
 	if getErr != nil {
-		panic(fmt.Errorf("Failed to get latest version of Deployment: %v", getErr))
+		log.Error("failed to get latest version of Deployment", "error", getErr)
+		decision.conclude(decisionOutcomeError, fmt.Sprintf("failed to get Deployment: %v", getErr))
+		return nodeselectors, false
 	}
 
 	deploymentAnnotations = deploymentData.Annotations
 
-	if strategy, ok := deploymentAnnotations["custom-pod-schedule-strategy"]; ok && strategy != "" {
+	// split parents run no pods of their own and the children carry their node selector already
+	if deploymentAnnotations[customPodScheduleModeKey] == scheduleModeSplit || deploymentAnnotations[customPodScheduleSplitParentKey] != "" {
+		log.Debug("deployment is placed by the splitter, ignoring")
+		decision.conclude(decisionOutcomeSkipped, "owner is placed by the splitter")
+		return nodeselectors, result
+	}
+
+	resolvedStrategy, resolveErr := ResolveStrategy(ctx, nameSpace, deploymentAnnotations)
+	if resolveErr != nil {
+		log.Error("failed to resolve custom scheduling strategy", "error", resolveErr)
+		decision.conclude(decisionOutcomeError, resolveErr.Error())
+		return nodeselectors, false
+	}
 
+	if resolvedStrategy != nil {
+
+		strategy := resolvedStrategy.Strategy
 		numOfReplicas = int(*deploymentData.Spec.Replicas)
-		if AppLogLevel == "INFO" || AppLogLevel == "TRACE" {
-			glog.Infof("flow=%s serviceInstanceNum=%d Found a deployment %s in namespace %s with total replicas %d and strategy=%s", flow, serviceInstanceNum, deploymentName, nameSpace, numOfReplicas, strategy)
+		countingMode := GetPodCountingMode(ctx, resolvedStrategy.CountingMode)
+
+		if placement.UsesCostWeights(strategy) {
+			weightedStrategy, costErr := CostWeightedStrategy(ctx, strategy)
+			if costErr != nil {
+				log.Error("failed to derive cost-weighted strategy", "strategy", strategy, "error", costErr)
+				decision.conclude(decisionOutcomeError, costErr.Error())
+				return nodeselectors, false
+			}
+			log.Info("derived cost-weighted strategy from the price table", "template", strategy, "strategy", weightedStrategy)
+			strategy = weightedStrategy
 		}
-
-		if nodeLabelStrategyList, ok := GetPodsCustomSchedulingStrategyList(strategy, numOfReplicas, serviceInstanceNum); ok {
-			if AppLogLevel == "INFO" || AppLogLevel == "TRACE" {
-				glog.Infof("flow=%s serviceInstanceNum=%d nodeLabelStrategyList=%v", flow, serviceInstanceNum, nodeLabelStrategyList)
+		log.Info("found deployment with custom scheduling strategy", "replicas", numOfReplicas, "strategy", strategy, "strategySource", resolvedStrategy.Source, "countingMode", countingMode)
+		decision.Strategy = strategy
+		decision.StrategySource = resolvedStrategy.Source
+		decision.CountingMode = countingMode
+		decision.Shadow = shadowMode || resolvedStrategy.Shadow
+
+		ownerNames := []string{deploymentName}
+		if group := deploymentAnnotations[customPodScheduleGroupKey]; group != "" {
+			quotaGroup, groupErr := GetQuotaGroup(ctx, nameSpace, group, deploymentAnnotations)
+			if groupErr != nil {
+				log.Error("failed to resolve quota group", "group", group, "error", groupErr)
+				decision.conclude(decisionOutcomeError, groupErr.Error())
+				return nodeselectors, false
 			}
+			ownerNames = quotaGroup.Members
+			numOfReplicas = quotaGroup.Replicas
+			log = log.With("group", group)
+			ctx = withLogger(ctx, log)
+			log.Info("placing pod within quota group", "members", ownerNames, "groupReplicas", numOfReplicas)
+			decision.Group = group
+			decision.GroupMembers = ownerNames
+		}
+		decision.Replicas = numOfReplicas
 
-			for _, nodeLabelStrategy := range nodeLabelStrategyList {
-				if AppLogLevel == "TRACE" {
-					glog.Infof("flow=%s serviceInstanceNum=%d nodeLabel=%s needs %d replicas\n", flow, serviceInstanceNum, nodeLabelStrategy.NodeLabel, nodeLabelStrategy.Replicas)
-				}
-				ExistingPodsList, result := GetNumOfExistingPods(nameSpace, deploymentName, nodeLabelStrategy.NodeLabel, serviceInstanceNum)
-				numOfExistingPods := len(ExistingPodsList)
-				if result {
-
-					if AppLogLevel == "INFO" || AppLogLevel == "TRACE" {
-						glog.Infof("flow=%s serviceInstanceNum=%d nodeLabel=%s currently runs %d pods", flow, serviceInstanceNum, nodeLabelStrategy.NodeLabel, numOfExistingPods)
-					}
-
-					if numOfExistingPods < nodeLabelStrategy.Replicas {
-						if flow == "CREATE" {
-							glog.Infof("flow=%s serviceInstanceNum=%d Currently running %d pods is less than expected %d, scheduling pod on nodeLabel %s", flow, serviceInstanceNum, numOfExistingPods, nodeLabelStrategy.Replicas, nodeLabelStrategy.NodeLabel)
-							nodeLabelSplit := strings.Split(nodeLabelStrategy.NodeLabel, "=")
-
-							nodeselectors[nodeLabelSplit[0]] = nodeLabelSplit[1]
-							return nodeselectors, result
-						}
-
-					} else if numOfExistingPods == nodeLabelStrategy.Replicas {
-
-						if AppLogLevel == "INFO" || AppLogLevel == "TRACE" {
-							glog.Infof("flow=%s serviceInstanceNum=%d Currently running %d pods is SAME as expected %d, ignoring the nodeLabel %s", flow, serviceInstanceNum, numOfExistingPods, nodeLabelStrategy.Replicas, nodeLabelStrategy.NodeLabel)
-						}
-
-					} else {
-						if flow == "DELETE" {
-							numOfPodsToBeDeleted := numOfExistingPods - nodeLabelStrategy.Replicas
-							glog.Infof("flow=%s serviceInstanceNum=%d Currently running %d pods is more than expected %d, So deleting %d pods on nodeLabel %s", flow, serviceInstanceNum, numOfExistingPods, nodeLabelStrategy.Replicas, numOfPodsToBeDeleted, nodeLabelStrategy.NodeLabel)
-							DeleteExtraPods(nameSpace, ExistingPodsList, numOfPodsToBeDeleted)
-						}
-					}
-
-				} else {
-					result = false
-					glog.Infof("flow=%s serviceInstanceNum=%d GetNumOfExistingPods failed. Ignoring Custom scheduling for nodeLabel=%s", flow, serviceInstanceNum, nodeLabelStrategy.NodeLabel)
-				}
+		nodeselectors, result = PlaceByStrategy(ctx, decision, nameSpace, deploymentName, strategy, numOfReplicas, countingMode, flow, func(ctx context.Context, nodeLabel string) ([]corev1.Pod, bool) {
+			if decision.Shadow {
+				return GetShadowPods(ctx, decision, nameSpace, ownerNames, nodeLabel)
 			}
-		} else {
-			result = false
-			glog.Infof("flow=%s serviceInstanceNum=%d Looks like Strategy declaration is wrong. Ignoring the custom scheduling. Pls fix and re-try", flow, serviceInstanceNum)
-		}
+			return GetNumOfExistingPods(ctx, nameSpace, ownerNames, nodeLabel)
+		})
+	} else {
+		decision.conclude(decisionOutcomeSkipped, "no strategy on the owner or its namespace")
 	}
 
 	return nodeselectors, result
 }
 
-func GetPodsCustomSchedulingStrategyList(Strategy string, numOfReplicas int, serviceInstanceNum int) ([]NodeLabelStrategy, bool) {
-
-	nodeLabelStrategyList := []NodeLabelStrategy{}
+// Distributes the replicas of an owner over the node labels of its strategy and records the
+// spread in the decision. In the CREATE flow it returns the node selector of the node label
+// the pod should go to. countPods returns the live pods of the owner on a node label.
+func PlaceByStrategy(ctx context.Context, decision *PlacementDecision, nameSpace string, owner string, strategy string, numOfReplicas int, countingMode string, flow string, countPods func(ctx context.Context, nodeLabel string) ([]corev1.Pod, bool)) (map[string]string, bool) {
 
 	result := true
+	nodeselectors := make(map[string]string)
+	log := loggerFrom(ctx)
 
-	if AppLogLevel == "INFO" || AppLogLevel == "TRACE" {
-		glog.Infof("serviceInstanceNum=%d Strategy=%s numOfReplicas=%d\n", serviceInstanceNum, Strategy, numOfReplicas)
-	}
-
-	totalWeight := 0
-	replicaCount := 0
-
-	StrategyList := strings.Split(Strategy, ":")
-
-	numOfBaseValues := 0
-
-	baseNodeLabel := ""
-
-	baseNodeLabelIndex := 0
-
-	for i, nodeStrategy := range StrategyList {
-
-		if AppLogLevel == "TRACE" {
-			fmt.Println("nodeStrategy: ", nodeStrategy)
+	if nodeLabelStrategyList, ok := GetPodsCustomSchedulingStrategyList(ctx, strategy, numOfReplicas); ok {
+		log.Info("computed node label strategy", "nodeLabelStrategyList", nodeLabelStrategyList)
+		for _, nodeLabelStrategy := range nodeLabelStrategyList {
+			desiredReplicasGauge.WithLabelValues(nameSpace, owner, nodeLabelStrategy.NodeLabel).Set(float64(nodeLabelStrategy.Replicas))
 		}
-
-		nodeStrategyPartsList := strings.Split(nodeStrategy, ",")
-
-		if AppLogLevel == "TRACE" {
-			fmt.Println("nodeStrategyPartsList: ", nodeStrategyPartsList)
-			fmt.Println("nodeStrategyPartsList len: ", len(nodeStrategyPartsList))
+		if cost, ok := ExpectedHourlyCost(ctx, nodeLabelStrategyList); ok {
+			log.Info("expected hourly cost of the spread", "cost", cost)
+			decision.ExpectedHourlyCost = cost
+			expectedHourlyCostGauge.WithLabelValues(nameSpace, owner).Set(cost)
 		}
+		nodePoolsAtLimit := []string{}
+
+		// nested strategies place the pod on their most under-filled leaf rather than the first
+		nested := placement.IsNested(strategy)
+		mostUnderFilledLabel, mostMissing := "", 0
+
+		for _, nodeLabelStrategy := range nodeLabelStrategyList {
+			log.Debug("node label needs replicas", "nodeLabel", nodeLabelStrategy.NodeLabel, "replicas", nodeLabelStrategy.Replicas)
+			ExistingPodsList, result := countPods(ctx, nodeLabelStrategy.NodeLabel)
+			numOfExistingPods := placement.CountPods(ExistingPodsList, countingMode)
+			if result {
+
+				log.Info("node label pod count", "nodeLabel", nodeLabelStrategy.NodeLabel, "current", numOfExistingPods, "desired", nodeLabelStrategy.Replicas)
+				decision.observe(nodeLabelStrategy.NodeLabel, nodeLabelStrategy.Replicas, numOfExistingPods)
+
+				if numOfExistingPods < nodeLabelStrategy.Replicas {
+					if atLimit, reason := nodePools.AtLimit(ctx, nodeLabelStrategy.NodeLabel); atLimit && flow == "CREATE" {
+						log.Info("current pods less than desired, but the node pool has reached its limit, trying the next node label", "nodeLabel", nodeLabelStrategy.NodeLabel, "reason", reason)
+						nodePoolsAtLimit = append(nodePoolsAtLimit, nodeLabelStrategy.NodeLabel)
+						continue
+					}
+					if flow == "CREATE" && nested {
+						if missing := nodeLabelStrategy.Replicas - numOfExistingPods; missing > mostMissing {
+							mostUnderFilledLabel, mostMissing = nodeLabelStrategy.NodeLabel, missing
+						}
+					} else if flow == "CREATE" {
+						log.Info("current pods less than desired, scheduling pod on node label", "nodeLabel", nodeLabelStrategy.NodeLabel, "current", numOfExistingPods, "desired", nodeLabelStrategy.Replicas)
+						for key, value := range placement.NodeSelectorOf(nodeLabelStrategy.NodeLabel) {
+							nodeselectors[key] = value
+						}
+						decision.ChosenLabel = nodeLabelStrategy.NodeLabel
+						decision.conclude(decisionOutcomePlaced, "")
+						return nodeselectors, result
+					}
 
-		base := 0
-		weight := 0
-		nodeLabel := ""
-		var err error
-
-		for _, nodeStrategyPart := range nodeStrategyPartsList {
-
-			nodeStrategySubPartList := strings.Split(nodeStrategyPart, "=")
-			if AppLogLevel == "TRACE" {
-				fmt.Println("nodeStrategyPart: ", nodeStrategyPart)
-				fmt.Println("nodeStrategySubPartList: ", nodeStrategySubPartList)
-				fmt.Println("nodeStrategySubPartList len: ", len(nodeStrategySubPartList))
-			}
-
-			if nodeStrategySubPartList[0] == "base" {
+				} else if numOfExistingPods == nodeLabelStrategy.Replicas {
 
-				if numOfBaseValues != 0 {
-					fmt.Println("base value cannot be non-zero for more than node strategy")
-					result = false
+					log.Info("current pods same as desired, ignoring node label", "nodeLabel", nodeLabelStrategy.NodeLabel, "current", numOfExistingPods, "desired", nodeLabelStrategy.Replicas)
 
 				} else {
-					numOfBaseValues += 1
-				}
-
-				base, err = strconv.Atoi(nodeStrategySubPartList[1])
-				if err != nil {
-					// handle error
-					fmt.Println(err)
-					os.Exit(2)
-				}
-
-				if base > numOfReplicas {
-					base = numOfReplicas
-				}
-
-				numOfReplicas = numOfReplicas - base
-
-				if AppLogLevel == "TRACE" {
-					fmt.Println("base=", base)
-				}
-
-			} else if nodeStrategySubPartList[0] == "weight" {
-
-				weight, err = strconv.Atoi(nodeStrategySubPartList[1])
-				if err != nil {
-					// handle error
-					fmt.Println(err)
-					os.Exit(2)
-				}
-				totalWeight += weight
-
-				if AppLogLevel == "TRACE" {
-					fmt.Println("weight=", weight)
+					if flow == "DELETE" {
+						// the reconciler evicts the excess pods within its disruption budget
+						log.Info("current pods more than desired, node label is over-provisioned", "nodeLabel", nodeLabelStrategy.NodeLabel, "current", numOfExistingPods, "desired", nodeLabelStrategy.Replicas, "excess", numOfExistingPods-nodeLabelStrategy.Replicas)
+					}
 				}
 
 			} else {
-				nodeLabel = nodeStrategyPart
-				if AppLogLevel == "TRACE" {
-					glog.Infof("label key=%s value=%s\n", nodeStrategySubPartList[0], nodeStrategySubPartList[1])
-				}
+				result = false
+				log.Warn("counting pods failed, ignoring custom scheduling for node label", "nodeLabel", nodeLabelStrategy.NodeLabel)
+				decision.conclude(decisionOutcomeError, "failed to count pods for "+nodeLabelStrategy.NodeLabel)
 			}
 		}
-
-		if numOfBaseValues == 1 {
-			if baseNodeLabel == "" {
-				baseNodeLabel = nodeLabel
-				baseNodeLabelIndex = i
+		if decision.Outcome == "" && mostUnderFilledLabel != "" {
+			log.Info("scheduling pod on the most under-filled leaf of the nested strategy", "nodeLabel", mostUnderFilledLabel, "missing", mostMissing)
+			for key, value := range placement.NodeSelectorOf(mostUnderFilledLabel) {
+				nodeselectors[key] = value
 			}
+			decision.ChosenLabel = mostUnderFilledLabel
+			decision.conclude(decisionOutcomePlaced, "")
+			return nodeselectors, result
 		}
-
-		nodeLabelStrategyList = append(nodeLabelStrategyList, NodeLabelStrategy{
-			NodeLabel: nodeLabel,
-			Replicas:  base,
-			Weight:    weight,
-		})
-
-	}
-
-	if numOfReplicas > 0 {
-
-		weight := nodeLabelStrategyList[baseNodeLabelIndex].Weight
-		baseReplicas := nodeLabelStrategyList[baseNodeLabelIndex].Replicas
-		weightReplicas := int(numOfReplicas * weight / totalWeight)
-		baseReplicas = baseReplicas + weightReplicas
-		replicaCount = weightReplicas
-
-		nodeLabelStrategyList[baseNodeLabelIndex].Replicas = baseReplicas
-
-		totalNumOfLables := len(nodeLabelStrategyList)
-		if AppLogLevel == "TRACE" {
-			glog.Infof("baseNodeLabel=%s baseReplicas = %v replicaCount=%v numOfReplicas=%v totalNumOfLables=%v\n", baseNodeLabel, baseReplicas, replicaCount, numOfReplicas, totalNumOfLables)
+		if decision.Outcome == "" && len(nodePoolsAtLimit) > 0 {
+			decision.conclude(decisionOutcomeUnchanged, "node pools missing pods have reached their limits: "+strings.Join(nodePoolsAtLimit, ", "))
+		} else if decision.Outcome == "" {
+			decision.conclude(decisionOutcomeUnchanged, "no node label needs more pods")
 		}
+	} else {
+		result = false
+		log.Warn("strategy declaration is wrong, ignoring the custom scheduling", "strategy", strategy)
+		decision.conclude(decisionOutcomeError, "invalid strategy")
+	}
 
-		labelNum := 0
-
-		for index, nodeLabelStrategy := range nodeLabelStrategyList {
-
-			if index != baseNodeLabelIndex {
-
-				if AppLogLevel == "TRACE" {
-					glog.Infof("labelNum=%v nodeLabelStrategy= %v totalWeight=%v replicaCount=%v numOfReplicas=%v\n", labelNum, nodeLabelStrategy, totalWeight, replicaCount, numOfReplicas)
-				}
-				if labelNum == totalNumOfLables-2 {
-					weightReplicas = numOfReplicas - replicaCount
-				} else {
-
-					weightReplicas = int(numOfReplicas * nodeLabelStrategy.Weight / totalWeight)
-				}
-
-				nodeLabelStrategy.Replicas += weightReplicas
-				replicaCount = replicaCount + weightReplicas
-
-				nodeLabelStrategyList[index] = nodeLabelStrategy
-
-				if AppLogLevel == "TRACE" {
-					glog.Infof("labelNum=%v weightReplicas: %v nodeLabelStrategy=%v,  replicaCount=%v, numOfReplicas=%v\n", labelNum, weightReplicas, nodeLabelStrategy, replicaCount, numOfReplicas)
-				}
-
-				labelNum += 1
-			}
-
-		}
+	return nodeselectors, result
+}
 
-		if AppLogLevel == "TRACE" {
-			glog.Infof("nodeLabelStrategyList = %v\n", nodeLabelStrategyList)
-			glog.Infof("numOfBaseValues = %v totalWeight=%v numOfReplicas=%v replicaCount=%v\n", numOfBaseValues, totalWeight, numOfReplicas, replicaCount)
-		}
+func GetPodsCustomSchedulingStrategyList(ctx context.Context, Strategy string, numOfReplicas int) ([]NodeLabelStrategy, bool) {
 
-	}
+	ctx, span := tracer.Start(ctx, "ParseStrategy", trace.WithAttributes(
+		attribute.String("placement.strategy", Strategy),
+		attribute.Int("placement.replicas", numOfReplicas),
+	))
+	defer span.End()
 
-	if AppLogLevel == "TRACE" {
-		glog.Infof("nodeLabelStrategyList = %v\n", nodeLabelStrategyList)
-		glog.Infof("numOfBaseValues = %v totalWeight=%v numOfReplicas=%v replicaCount=%v\n", numOfBaseValues, totalWeight, numOfReplicas, replicaCount)
+	nodeLabelStrategyList, err := placement.Distribute(loggerFrom(ctx), Strategy, numOfReplicas)
+	if err != nil {
+		spanError(span, err)
+		return nodeLabelStrategyList, false
 	}
 
-	return nodeLabelStrategyList, result
+	return nodeLabelStrategyList, true
 }
 
-func GetNumOfExistingPods(namespace string, deploymentName string, nodeLabel string, serviceInstanceNum int) ([]string, bool) {
+// Returns the live pods of the given owners that select nodeLabel
+func GetNumOfExistingPods(ctx context.Context, namespace string, ownerNames []string, nodeLabel string) ([]corev1.Pod, bool) {
+	ctx, span := tracer.Start(ctx, "CountPods", trace.WithAttributes(attribute.String("placement.node_label", nodeLabel)))
+	defer span.End()
+
 	result := true
 
-	ExistingPodsList := []string{}
+	ExistingPodsList := []corev1.Pod{}
 
-	if AppLogLevel == "TRACE" {
-		glog.Infof("serviceInstanceNum=%d GetNumOfExistingPods namespace=%v deploymentName=%v nodeLabel=%v\n", serviceInstanceNum, namespace, deploymentName, nodeLabel)
-	}
-	nodeLabelSplit := strings.Split(nodeLabel, "=")
+	log := loggerFrom(ctx)
+	log.Debug("GetNumOfExistingPods", "ownerNames", ownerNames, "nodeLabel", nodeLabel)
 
 	listOptions := metav1.ListOptions{}
 	//time.Sleep(1 * time.Second)
-	time.Sleep(500 * time.Millisecond) // this is to give enough time for concurrent writes to etcd from other mutatting requests
-	pods, err := api.Pods(namespace).List(context.Background(), listOptions)
+	time.Sleep(podListDelay) // this is to give enough time for concurrent writes to etcd from other mutatting requests
+	pods, err := api.Pods(namespace).List(ctx, listOptions)
 	if err != nil {
-		result = false
-		log.Fatalln("failed to get pods:", err)
+		log.Error("failed to get pods", "error", err)
+		spanError(span, err)
+		return ExistingPodsList, false
 	}
 
 	for _, pod := range pods.Items {
 
-		if strings.Contains(pod.Name, deploymentName) {
-
-			nodeSelectorMap := pod.Spec.NodeSelector
+		if podBelongsToOwners(pod.Name, ownerNames) {
 
-			for nodeLabelKey, nodeLabelValue := range nodeSelectorMap {
-				if nodeLabelKey == nodeLabelSplit[0] && nodeLabelValue == nodeLabelSplit[1] {
-					if pod.DeletionTimestamp == nil {
+			if placement.MatchesNodeLabel(pod.Spec.NodeSelector, nodeLabel) && pod.DeletionTimestamp == nil {
 
-						ExistingPodsList = append(ExistingPodsList, pod.Name)
-					}
-
-				}
+				ExistingPodsList = append(ExistingPodsList, pod)
 			}
 
 		}
@@ -605,14 +683,51 @@ func GetNumOfExistingPods(namespace string, deploymentName string, nodeLabel str
 	return ExistingPodsList, result
 }
 
-func DeleteExtraPods(nameSpace string, ExistingPodsList []string, numOfPodsToBeDeleted int) {
+func podBelongsToOwners(podName string, ownerNames []string) bool {
+	for _, ownerName := range ownerNames {
+		if strings.Contains(podName, ownerName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the counting mode for a strategy, falling back to counting all live pods
+// when the annotation is absent or not recognised
+func GetPodCountingMode(ctx context.Context, mode string) string {
+	switch mode {
+	case podCountingModeAll, podCountingModeScheduled, podCountingModeReady:
+		return mode
+	case "":
+		return podCountingModeAll
+	default:
+		loggerFrom(ctx).Warn("unknown counting mode, counting all live pods", "annotation", customPodScheduleCountingModeKey, "countingMode", mode)
+		return podCountingModeAll
+	}
+}
 
-	for i := 0; i < numOfPodsToBeDeleted; i++ {
-		podName := ExistingPodsList[i]
-		glog.Infof("Deleting the pod i %d Name %s", i, podName)
-		err := api.Pods(nameSpace).Delete(context.TODO(), podName, metav1.DeleteOptions{})
-		if err != nil {
-			log.Fatal(err)
+// Returns pod names ordered so that pods which are not scheduled, then pods which
+// are not ready, are deleted before ready ones
+func OrderPodsForDeletion(pods []corev1.Pod) []string {
+	rank := func(pod *corev1.Pod) int {
+		if placement.IsPodReady(pod) {
+			return 2
+		}
+		if placement.IsPodScheduled(pod) {
+			return 1
 		}
+		return 0
+	}
+
+	ordered := make([]corev1.Pod, len(pods))
+	copy(ordered, pods)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return rank(&ordered[i]) < rank(&ordered[j])
+	})
+
+	podNames := make([]string, 0, len(ordered))
+	for _, pod := range ordered {
+		podNames = append(podNames, pod.Name)
 	}
+	return podNames
 }